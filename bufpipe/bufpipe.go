@@ -7,6 +7,8 @@ package bufpipe
 
 import "io"
 import "sync"
+import "errors"
+import "sync/atomic"
 
 // There are a number of modes of operation that BufferPipe can operate in.
 //
@@ -14,7 +16,8 @@ import "sync"
 // bitwise ORed together to create the mode of operation. Thus, with 4 flags,
 // there are technically 16 different possible combinations (although, some of
 // them are illogical). All 16 combinations are allowed, even if no sensible
-// programmer should be using them.
+// programmer should be using them. Additional flags that only affect the
+// implementation (and not the semantics) may be ORed with any combination.
 //
 // The first flag determines the buffer's structure (linear vs. ring). In linear
 // mode, a writer can only write up to the internal buffer length's worth of
@@ -43,19 +46,39 @@ import "sync"
 // the buffer is full.
 //
 // With all illogical combinations removed, there are only 8 logical
-// combinations that programmers should use.
+// combinations that programmers should use. The New constructor rejects
+// any of the illogical combinations.
+//
+// The SPSC flag promises that there is at most a single producer routine and
+// a single consumer routine. In this mode, the read and write pointers are
+// accessed atomically, such that the producer and consumer only synchronize
+// with each other using locks when one side actually needs to block. In this
+// mode, Reset may only be called when no other routine is using the pipe.
+//
+// The Staged flag separates writing data from making it visible to readers.
+// Written data is only visible to readers once the writer calls Commit.
+// Until then, the writer may modify the uncommitted data (e.g., to backpatch a
+// length header) or discard it with Rollback, even while readers concurrently
+// consume previously committed data in Dual mode. Closing the pipe does not
+// implicitly commit any data. If the buffer fills up with uncommitted data,
+// then readers can never make space available. Thus, rather than blocking
+// forever in BlockI mode, writers report ErrStagedFull in this situation.
 const (
 	Ring   = 1 << iota // Ring buffer vs. linear buffer
 	Dual               // Dual access IO vs. mono access IO
 	BlockI             // Blocking input vs. polling input
 	BlockO             // Blocking output vs. polling output
+	SPSC               // Single producer and consumer vs. multiple of each
+	Staged             // Explicitly committed IO vs. immediately visible IO
 
 	// The below flags are the inverse of the ones above. They exist to make it
 	// obvious what the inverse is.
-	Line  = 0 // Inverse of Ring
-	Mono  = 0 // Inverse of Dual
-	PollI = 0 // Inverse of BlockI
-	PollO = 0 // Inverse of BlockO
+	Line   = 0 // Inverse of Ring
+	Mono   = 0 // Inverse of Dual
+	PollI  = 0 // Inverse of BlockI
+	PollO  = 0 // Inverse of BlockO
+	MPMC   = 0 // Inverse of SPSC
+	Direct = 0 // Inverse of Staged
 )
 
 // The most common combination of flags are predefined with convenient aliases.
@@ -66,16 +89,49 @@ const (
 	RingBlock = Ring | Dual | BlockI | BlockO
 )
 
+// ErrStagedFull is reported by writers in Staged mode with BlockI when the
+// buffer is full and none of the data has been committed, such that blocking
+// would wait forever. The writer must Commit or Rollback to make progress.
+var ErrStagedFull = errors.New("bufpipe: buffer is full of uncommitted data")
+
 type BufferPipe struct {
+	// The pointers are accessed atomically in SPSC mode and must be 64-bit
+	// aligned, which is only guaranteed for the first word in a struct.
+	rdPtr int64
+	wrPtr int64
+	cmPtr int64 // Data before the commit pointer is visible to readers
+
+	// Statistics that are always accessed atomically.
+	wrCnt  int64 // Total bytes written
+	rdCnt  int64 // Total bytes read
+	wrIdle int64 // Total nanoseconds writers spent blocked
+	rdIdle int64 // Total nanoseconds readers spent blocked
+
+	// Atomic variables used by the SPSC mode. The done flag mirrors the closed
+	// field, while the wait flags are set when a routine is blocked waiting.
+	done   int32
+	rdWait int32
+	wrWait int32
+
+	freed int32 // Whether the pipe has been released to the pool
+
 	buf    []byte
 	mode   int
-	rdPtr  int64
-	wrPtr  int64
 	closed bool
 	err    error
+	wrErr  error // Error for writers that takes precedence over err
+	rdDone bool  // Whether the read half of a pipe has been closed
+	pool   *Pool // Pool that the pipe belongs to; may be nil
 	mutex  sync.Mutex
 	rdCond sync.Cond
 	wrCond sync.Cond
+	vbuf   []byte       // Doubly mapped view of buf; may be nil
+	unmap  func() error // Releases a memory mapped buf; may be nil
+
+	lowMark   int             // Length at which a high pressure state ends
+	highMark  int             // Length at which a high pressure state starts
+	notify    func(high bool) // Watermark callback; may be nil
+	aboveHigh bool            // Whether in a high pressure state
 }
 
 // BufferPipe is similar in operation to io.Pipe and is intended to be the
@@ -102,29 +158,37 @@ func NewBufferPipe(buf []byte, mode int) *BufferPipe {
 // Line buffers are always guaranteed to be aligned to be front of the slice.
 // Ring buffers use wrap around logic and could be physically split apart.
 func (b *BufferPipe) Buffer() []byte {
+	b.checkFreed()
 	return b.buf
 }
 
 // The BufferPipe mode of operation.
+// Use Mode(b.Mode()) to format or validate it as a Mode.
 func (b *BufferPipe) Mode() int {
+	b.checkFreed()
 	return b.mode
 }
 
 // The internal pointer values.
 func (b *BufferPipe) Pointers() (rdPtr, wrPtr int64) {
-	return b.rdPtr, b.wrPtr
+	b.checkFreed()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return atomic.LoadInt64(&b.rdPtr), atomic.LoadInt64(&b.wrPtr)
 }
 
 // The total number of bytes the buffer can store.
 func (b *BufferPipe) Capacity() int {
+	b.checkFreed()
 	return len(b.buf)
 }
 
 // The number of valid bytes that can be read.
 func (b *BufferPipe) Length() int {
+	b.checkFreed()
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
-	return int(b.wrPtr - b.rdPtr)
+	return int(atomic.LoadInt64(&b.cmPtr) - atomic.LoadInt64(&b.rdPtr))
 }
 
 func (b *BufferPipe) writeWait() int {
@@ -137,8 +201,8 @@ func (b *BufferPipe) writeWait() int {
 		rdPtr = &rdZero // Amount read has no effect on amount available
 	}
 	if isBlock {
-		for !b.closed && len(b.buf) == int(b.wrPtr-(*rdPtr)) {
-			b.wrCond.Wait()
+		for !b.closed && len(b.buf) == int(b.wrPtr-(*rdPtr)) && !b.stagedFull() {
+			b.wait(&b.wrCond, &b.wrIdle)
 		}
 	}
 	if b.closed {
@@ -170,6 +234,10 @@ func (b *BufferPipe) WriteSlices() (bufLo, bufHi []byte, err error) {
 	if b == nil {
 		return nil, nil, nil
 	}
+	b.checkFreed()
+	if b.mode&SPSC > 0 {
+		return b.writeSlicesSPSC()
+	}
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 	return b.writeSlices()
@@ -177,33 +245,55 @@ func (b *BufferPipe) WriteSlices() (bufLo, bufHi []byte, err error) {
 
 func (b *BufferPipe) writeSlices() (bufLo, bufHi []byte, err error) {
 	availCnt := b.writeWait() // Block until there is available buffer
+	bufLo, bufHi = b.slices(b.wrPtr, availCnt)
+	if len(bufLo) == 0 {
+		err = b.writeErr()
+	}
+	return
+}
+
+// The error status for a writer when there is no available buffer.
+func (b *BufferPipe) writeErr() error {
+	switch {
+	case b.wrErr != nil:
+		return b.wrErr
+	case b.err != nil:
+		return b.err
+	case b.closed:
+		return io.ErrClosedPipe
+	case b.mode&BlockI > 0 && b.stagedFull():
+		return ErrStagedFull
+	default:
+		return io.ErrShortWrite
+	}
+}
+
+// Reports whether readers have drained all committed data in Staged mode,
+// such that they can never make more buffer available for a blocked writer.
+func (b *BufferPipe) stagedFull() bool {
+	return b.mode&Staged > 0 && atomic.LoadInt64(&b.rdPtr) == atomic.LoadInt64(&b.cmPtr)
+}
+
+// The slices of cnt bytes of the buffer starting at the given pointer.
+func (b *BufferPipe) slices(ptr int64, cnt int) (bufLo, bufHi []byte) {
 	offLo := 0
 	if len(b.buf) > 0 { // Prevent division by zero
-		offLo = int(b.wrPtr) % len(b.buf)
+		offLo = int(ptr % int64(len(b.buf)))
 	}
-	offHi := offLo + availCnt
-	if modCnt := offHi - len(b.buf); modCnt > 0 {
+	offHi := offLo + cnt
+	buf := b.buf
+	if b.vbuf != nil {
+		buf = b.vbuf // Mirror past the end keeps everything contiguous
+	} else if modCnt := offHi - len(b.buf); modCnt > 0 {
 		offHi = len(b.buf)
 		bufHi = b.buf[:modCnt] // Upper half (possible for Ring)
 	}
-	bufLo = b.buf[offLo:offHi] // Bottom half (will contain all data for Line)
+	bufLo = buf[offLo:offHi] // Bottom half (will contain all data for Line)
 
 	// Restrict the capacity to prevent users from accidentally going past end.
 	bufLo = bufLo[:len(bufLo):len(bufLo)]
 	bufHi = bufHi[:len(bufHi):len(bufHi)]
-
-	// Check error status
-	if len(bufLo) == 0 {
-		switch {
-		case b.err != nil:
-			err = b.err
-		case b.closed:
-			err = io.ErrClosedPipe
-		default:
-			err = io.ErrShortWrite
-		}
-	}
-	return
+	return bufLo, bufHi
 }
 
 // Advances the write pointer.
@@ -218,19 +308,40 @@ func (b *BufferPipe) WriteMark(cnt int) {
 	if b == nil && cnt == 0 {
 		return
 	}
+	b.checkFreed()
+	if err := b.writeMarkErr(cnt); err != nil {
+		panic("invalid mark increment value")
+	}
+}
+
+// Advances the write pointer like WriteMark, but reports an error rather than
+// panicking if the pipe was closed since the slices were obtained, in which
+// case the marked data is discarded.
+func (b *BufferPipe) writeMarkErr(cnt int) error {
+	if b.mode&SPSC > 0 {
+		return b.writeMarkSPSC(cnt)
+	}
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
-	b.writeMark(cnt)
+	return b.writeMark(cnt)
 }
 
-func (b *BufferPipe) writeMark(cnt int) {
+func (b *BufferPipe) writeMark(cnt int) error {
+	if cnt > 0 && b.closed {
+		return b.writeErr()
+	}
 	availCnt := b.writeWait()
 	if cnt < 0 || cnt > availCnt {
 		panic("invalid mark increment value")
 	}
 	b.wrPtr += int64(cnt)
-
-	b.rdCond.Signal()
+	atomic.AddInt64(&b.wrCnt, int64(cnt))
+	if b.mode&Staged == 0 {
+		b.cmPtr = b.wrPtr
+		b.checkWatermarks()
+		b.rdCond.Signal()
+	}
+	return nil
 }
 
 // Write data to the buffer.
@@ -243,6 +354,10 @@ func (b *BufferPipe) writeMark(cnt int) {
 // Under Block mode, this operation will block until all data has been written.
 // If there is no consumer of the data, then this method may block forever.
 func (b *BufferPipe) Write(data []byte) (cnt int, err error) {
+	b.checkFreed()
+	if b.mode&SPSC > 0 {
+		return b.writeSPSC(data)
+	}
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
@@ -260,7 +375,17 @@ func (b *BufferPipe) Write(data []byte) (cnt int, err error) {
 }
 
 // Continually read the contents of the reader and write them to the pipe.
+//
+// If the reader is a syscall.Conn (e.g., *os.File or *net.TCPConn), then this
+// is equivalent to ReadFromConn on platforms that support vectored I/O.
 func (b *BufferPipe) ReadFrom(rd io.Reader) (cnt int64, err error) {
+	b.checkFreed()
+	if rc := rawConn(rd); rc != nil {
+		return b.readFromConn(rc)
+	}
+	if b.mode&SPSC > 0 {
+		return b.readFromSPSC(rd)
+	}
 	for {
 		b.mutex.Lock()
 		buf, _, wrErr := b.writeSlices()
@@ -284,17 +409,17 @@ func (b *BufferPipe) readWait() int {
 	isBlock := b.mode&BlockO > 0
 	isMono := b.mode&Dual == 0
 	if isBlock {
-		for !b.closed && b.rdPtr == b.wrPtr {
-			b.rdCond.Wait()
+		for !b.closed && b.rdPtr == b.cmPtr {
+			b.wait(&b.rdCond, &b.rdIdle)
 		}
 		for isMono && !b.closed {
-			b.rdCond.Wait()
+			b.wait(&b.rdCond, &b.rdIdle)
 		}
 	}
-	if isMono && !b.closed {
+	if (isMono && !b.closed) || b.rdDone {
 		return 0
 	}
-	return int(b.wrPtr - b.rdPtr)
+	return int(b.cmPtr - b.rdPtr)
 }
 
 // Slices of valid data that can be read. This does not advance the internal
@@ -316,6 +441,10 @@ func (b *BufferPipe) ReadSlices() (bufLo, bufHi []byte, err error) {
 	if b == nil {
 		return nil, nil, nil
 	}
+	b.checkFreed()
+	if b.mode&SPSC > 0 {
+		return b.readSlicesSPSC()
+	}
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 	return b.readSlices()
@@ -323,35 +452,27 @@ func (b *BufferPipe) ReadSlices() (bufLo, bufHi []byte, err error) {
 
 func (b *BufferPipe) readSlices() (bufLo, bufHi []byte, err error) {
 	validCnt := b.readWait() // Block until there is valid buffer
-	offLo := 0
-	if len(b.buf) > 0 { // Prevent division by zero
-		offLo = int(b.rdPtr) % len(b.buf)
-	}
-	offHi := offLo + validCnt
-	if modCnt := offHi - len(b.buf); modCnt > 0 {
-		offHi = len(b.buf)
-		bufHi = b.buf[:modCnt] // Upper half (possible for Ring)
-	}
-	bufLo = b.buf[offLo:offHi] // Bottom half (will contain all data for Line)
-
-	// Restrict the capacity to prevent users from accidentally going past end.
-	bufLo = bufLo[:len(bufLo):len(bufLo)]
-	bufHi = bufHi[:len(bufHi):len(bufHi)]
-
-	// Check error status
+	bufLo, bufHi = b.slices(b.rdPtr, validCnt)
 	if len(bufLo) == 0 {
-		switch {
-		case b.err != nil:
-			err = b.err
-		case b.closed:
-			err = io.EOF
-		default:
-			err = io.ErrNoProgress
-		}
+		err = b.readErr()
 	}
 	return
 }
 
+// The error status for a reader when there is no valid data.
+func (b *BufferPipe) readErr() error {
+	switch {
+	case b.rdDone:
+		return io.ErrClosedPipe
+	case b.err != nil:
+		return b.err
+	case b.closed:
+		return io.EOF
+	default:
+		return io.ErrNoProgress
+	}
+}
+
 // Advances the read pointer.
 //
 // The amount that can be advanced must be non-negative and be less than the
@@ -364,19 +485,37 @@ func (b *BufferPipe) ReadMark(cnt int) {
 	if b == nil && cnt == 0 {
 		return
 	}
+	b.checkFreed()
+	if err := b.readMarkErr(cnt); err != nil {
+		panic("invalid mark increment value")
+	}
+}
+
+// Advances the read pointer like ReadMark, but reports an error rather than
+// panicking if the read half was closed since the slices were obtained.
+func (b *BufferPipe) readMarkErr(cnt int) error {
+	if b.mode&SPSC > 0 {
+		return b.readMarkSPSC(cnt)
+	}
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
-	b.readMark(cnt)
+	return b.readMark(cnt)
 }
 
-func (b *BufferPipe) readMark(cnt int) {
+func (b *BufferPipe) readMark(cnt int) error {
+	if cnt > 0 && b.rdDone {
+		return b.readErr()
+	}
 	validCnt := b.readWait()
 	if cnt < 0 || cnt > validCnt {
 		panic("invalid mark increment value")
 	}
 	b.rdPtr += int64(cnt)
+	atomic.AddInt64(&b.rdCnt, int64(cnt))
+	b.checkWatermarks()
 
 	b.wrCond.Signal()
+	return nil
 }
 
 // Read data from the buffer.
@@ -387,6 +526,10 @@ func (b *BufferPipe) readMark(cnt int) {
 //
 // Under Block mode, this method may block forever if there is no producer.
 func (b *BufferPipe) Read(data []byte) (cnt int, err error) {
+	b.checkFreed()
+	if b.mode&SPSC > 0 {
+		return b.readSPSC(data)
+	}
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 
@@ -404,7 +547,17 @@ func (b *BufferPipe) Read(data []byte) (cnt int, err error) {
 }
 
 // Continually read the contents of the pipe and write them to the writer.
+//
+// If the writer is a syscall.Conn (e.g., *os.File or *net.TCPConn), then this
+// is equivalent to WriteToConn on platforms that support vectored I/O.
 func (b *BufferPipe) WriteTo(wr io.Writer) (cnt int64, err error) {
+	b.checkFreed()
+	if rc := rawConn(wr); rc != nil {
+		return b.writeToConn(rc)
+	}
+	if b.mode&SPSC > 0 {
+		return b.writeToSPSC(wr)
+	}
 	for {
 		b.mutex.Lock()
 		data, _, rdErr := b.readSlices()
@@ -442,10 +595,11 @@ func (b *BufferPipe) Close() error {
 // Closes the pipe with the given error. This sets the error value for the pipe
 // and returns the previous error value.
 func (b *BufferPipe) CloseWithError(err error) (errPre error) {
+	b.checkFreed()
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 	errPre, b.err = b.err, err
-	b.closed = true
+	b.setClosed(true)
 	b.rdCond.Broadcast()
 	b.wrCond.Broadcast()
 	return errPre
@@ -455,24 +609,98 @@ func (b *BufferPipe) CloseWithError(err error) (errPre error) {
 // If successful, this effectively makes the valid length zero. In order to
 // prevent race conditions with the reader, this action is only valid in Mono
 // access mode before the channel is closed.
+//
+// In Staged mode, this instead rolls the write pointer back to the last commit,
+// discarding all uncommitted data. This is valid in both Mono and Dual access
+// modes before the channel is closed.
 func (b *BufferPipe) Rollback() int {
+	b.checkFreed()
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
-	if b.closed || b.mode&Dual > 0 {
+	if b.closed {
+		return 0
+	}
+	if b.mode&Staged > 0 {
+		cnt := b.wrPtr - b.cmPtr
+		atomic.StoreInt64(&b.wrPtr, b.cmPtr)
+		return int(cnt)
+	}
+	if b.mode&Dual > 0 {
 		return 0
 	}
 	cnt := b.wrPtr - b.rdPtr
-	b.wrPtr = b.rdPtr
+	atomic.StoreInt64(&b.wrPtr, b.rdPtr)
+	atomic.StoreInt64(&b.cmPtr, b.rdPtr)
+	b.checkWatermarks()
+	return int(cnt)
+}
+
+// Slices of written data that has not yet been committed. All of the staged
+// data is the logical concatenation of the two slices. The writer may modify
+// the staged data in place until the next call to Commit or Rollback.
+//
+// Data is only ever staged in Staged mode.
+func (b *BufferPipe) StagedSlices() (bufLo, bufHi []byte) {
+	b.checkFreed()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.slices(b.cmPtr, int(b.wrPtr-b.cmPtr))
+}
+
+// Commit the staged data, making it visible to readers, and return the number
+// of bytes committed. This only has an effect in Staged mode before the
+// channel is closed.
+//
+// If Commit is being used, only one writer routine is allowed.
+func (b *BufferPipe) Commit() int {
+	b.checkFreed()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return 0
+	}
+	cnt := b.wrPtr - b.cmPtr
+	atomic.StoreInt64(&b.cmPtr, b.wrPtr)
+	b.checkWatermarks()
+	b.rdCond.Signal()
 	return int(cnt)
 }
 
 // Makes the buffer ready for use again by opening the pipe for writing again.
 // The read and write pointers will be reset to zero and errors will be cleared.
+// Statistics are also reset to zero.
 func (b *BufferPipe) Reset() {
+	b.checkFreed()
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
-	b.wrPtr, b.rdPtr = 0, 0
-	b.err, b.closed = nil, false
+	b.reset()
+}
+
+func (b *BufferPipe) reset() {
+	atomic.StoreInt64(&b.wrPtr, 0)
+	atomic.StoreInt64(&b.rdPtr, 0)
+	atomic.StoreInt64(&b.cmPtr, 0)
+	atomic.StoreInt64(&b.wrCnt, 0)
+	atomic.StoreInt64(&b.rdCnt, 0)
+	atomic.StoreInt64(&b.wrIdle, 0)
+	atomic.StoreInt64(&b.rdIdle, 0)
+	b.aboveHigh = false
+	b.err, b.wrErr, b.rdDone = nil, nil, false
+	b.setClosed(false)
+}
+
+// Sets the closed state, which is mirrored by the done flag for SPSC mode.
+// The done flag is 0 if open, 1 if closed, and 2 if the read half is closed.
+func (b *BufferPipe) setClosed(closed bool) {
+	var done int32
+	switch {
+	case b.rdDone:
+		done = 2
+	case closed:
+		done = 1
+	}
+	b.closed = closed
+	atomic.StoreInt32(&b.done, done)
 }
 
 // TODO(jtsai): Allow BufferPipe to be grown. This is safe at Reset time and
@@ -4,4 +4,694 @@
 
 package bufpipe
 
-// TODO(jtsai): Finish this!
+import "io"
+import "os"
+import "fmt"
+import "bytes"
+import "errors"
+import "time"
+import "reflect"
+import "testing"
+import "io/ioutil"
+import "math/rand"
+
+// testStream writes data into b from one routine while reading it back from
+// another, and reports whether the data read matches the data written.
+func testStream(t *testing.T, b *BufferPipe, data []byte) {
+	t.Helper()
+	go func() {
+		defer b.Close()
+		r := rand.New(rand.NewSource(0))
+		for buf := data; len(buf) > 0; {
+			cnt := r.Intn(len(buf)) + 1
+			if _, err := b.Write(buf[:cnt]); err != nil {
+				t.Errorf("unexpected Write error: %v", err)
+				return
+			}
+			buf = buf[cnt:]
+		}
+	}()
+
+	got, err := ioutil.ReadAll(b)
+	if err != nil {
+		t.Fatalf("unexpected ReadAll error: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("mismatching data:\ngot  %d bytes\nwant %d bytes", len(got), len(data))
+	}
+}
+
+func TestFileBufferPipe(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(0)).Read(data)
+
+	// Ring mode allows data far larger than the file to stream through.
+	b, err := NewFileBufferPipe(f, 4096, RingBlock)
+	if err == errNoMmap {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatalf("unexpected NewFileBufferPipe error: %v", err)
+	}
+	if b.Capacity() != 4096 {
+		t.Fatalf("Capacity() = %d, want %d", b.Capacity(), 4096)
+	}
+	testStream(t, b, data)
+	if err := b.Unmap(); err != nil {
+		t.Fatalf("unexpected Unmap error: %v", err)
+	}
+	if _, err := b.Write([]byte("#")); err != io.ErrClosedPipe {
+		t.Fatalf("Write() after Unmap = %v, want %v", err, io.ErrClosedPipe)
+	}
+
+	// Data written in Line mode is visible in the underlying file.
+	b, err = NewFileBufferPipe(f, 4096, LineMono)
+	if err != nil {
+		t.Fatalf("unexpected NewFileBufferPipe error: %v", err)
+	}
+	defer b.Unmap()
+	if _, err := b.Write(data[:4096]); err != nil {
+		t.Fatalf("unexpected Write error: %v", err)
+	}
+	got := make([]byte, 4096)
+	if _, err := f.ReadAt(got, 0); err != nil {
+		t.Fatalf("unexpected ReadAt error: %v", err)
+	}
+	if !bytes.Equal(got, data[:4096]) {
+		t.Fatalf("file contents do not match data written to pipe")
+	}
+}
+
+func TestVirtualRingBufferPipe(t *testing.T) {
+	b := NewVirtualRingBufferPipe(1000, RingPoll)
+	defer b.Unmap()
+	if b.vbuf == nil {
+		t.Skip("virtual rings not supported")
+	}
+	if b.Capacity() < 1000 || b.Capacity()%os.Getpagesize() != 0 {
+		t.Fatalf("Capacity() = %d, want page-aligned value of at least %d", b.Capacity(), 1000)
+	}
+
+	// Advance the pointers such that the available space wraps around.
+	size := b.Capacity()
+	b.WriteMark(size - 10)
+	b.ReadMark(size - 10)
+
+	data := make([]byte, size)
+	rand.New(rand.NewSource(0)).Read(data)
+	bufLo, bufHi, err := b.WriteSlices()
+	if len(bufLo) != size || len(bufHi) != 0 || err != nil {
+		t.Fatalf("WriteSlices() = (%d, %d, %v), want (%d, 0, nil)", len(bufLo), len(bufHi), err, size)
+	}
+	copy(bufLo, data)
+	b.WriteMark(size)
+
+	bufLo, bufHi, err = b.ReadSlices()
+	if len(bufLo) != size || len(bufHi) != 0 || err != nil {
+		t.Fatalf("ReadSlices() = (%d, %d, %v), want (%d, 0, nil)", len(bufLo), len(bufHi), err, size)
+	}
+	if !bytes.Equal(bufLo, data) {
+		t.Fatalf("mismatching data read from virtual ring")
+	}
+	if !bytes.Equal(b.Buffer()[:10], data[10:20]) {
+		t.Fatalf("data written past the end did not wrap around to the front")
+	}
+	b.ReadMark(size)
+
+	b = NewVirtualRingBufferPipe(1000, RingBlock)
+	defer b.Unmap()
+	testStream(t, b, append(data, data...))
+}
+
+func TestSPSC(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(0)).Read(data)
+
+	for _, mode := range []int{RingBlock, RingBlock | SPSC} {
+		testStream(t, NewBufferPipe(make([]byte, 4096), mode), data)
+	}
+	for _, mode := range []int{LineDual, LineDual | SPSC, LineMono | SPSC} {
+		testStream(t, NewBufferPipe(make([]byte, len(data)), mode), data)
+	}
+}
+
+func BenchmarkPipe(b *testing.B) {
+	const chunkSize = 256
+	run := func(b *testing.B, rd io.Reader, wr io.WriteCloser) {
+		go func() {
+			defer wr.Close()
+			chunk := make([]byte, chunkSize)
+			for i := 0; i < b.N; i++ {
+				wr.Write(chunk)
+			}
+		}()
+		chunk := make([]byte, chunkSize)
+		b.SetBytes(chunkSize)
+		b.ResetTimer()
+		for {
+			if _, err := io.ReadFull(rd, chunk); err != nil {
+				break
+			}
+		}
+	}
+
+	b.Run("IOPipe", func(b *testing.B) {
+		rd, wr := io.Pipe()
+		run(b, rd, wr)
+	})
+	b.Run("RingBlock", func(b *testing.B) {
+		p := NewBufferPipe(make([]byte, 64<<10), RingBlock)
+		run(b, p, p)
+	})
+	b.Run("RingBlockSPSC", func(b *testing.B) {
+		p := NewBufferPipe(make([]byte, 64<<10), RingBlock|SPSC)
+		run(b, p, p)
+	})
+}
+
+func TestStaged(t *testing.T) {
+	for _, mode := range []int{RingBlock | Staged, RingBlock | Staged | SPSC} {
+		b := NewBufferPipe(make([]byte, 64), mode)
+
+		// Each record is a 2-digit length header backpatched after the payload
+		// has been written. Every other record is discarded by the writer.
+		go func() {
+			defer b.Close()
+			for i := 0; i < 100; i++ {
+				b.Write([]byte("##"))
+				cnt, _ := b.Write(bytes.Repeat([]byte{'a' + byte(i%26)}, i%30))
+				if i%2 == 1 {
+					if n := b.Rollback(); n != 2+cnt {
+						t.Errorf("Rollback() = %d, want %d", n, 2+cnt)
+					}
+					continue
+				}
+				hdr := fmt.Sprintf("%02d", cnt)
+				hdrLo, hdrHi := b.StagedSlices()
+				copy(hdrHi, hdr[copy(hdrLo, hdr):])
+				if n := b.Commit(); n != 2+cnt {
+					t.Errorf("Commit() = %d, want %d", n, 2+cnt)
+				}
+			}
+			if _, err := b.Write([]byte("uncommitted")); err != nil {
+				t.Errorf("unexpected Write error: %v", err)
+			}
+		}()
+
+		got, err := ioutil.ReadAll(b)
+		if err != nil {
+			t.Fatalf("unexpected ReadAll error: %v", err)
+		}
+		var want []byte
+		for i := 0; i < 100; i += 2 {
+			want = append(want, fmt.Sprintf("%02d", i%30)...)
+			want = append(want, bytes.Repeat([]byte{'a' + byte(i%26)}, i%30)...)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("mismatching data:\ngot  %q\nwant %q", got, want)
+		}
+	}
+}
+
+func TestStagedFull(t *testing.T) {
+	for _, mode := range []int{RingBlock | Staged, RingBlock | Staged | SPSC} {
+		b := NewBufferPipe(make([]byte, 8), mode)
+		if cnt, err := b.Write([]byte("0123456789")); cnt != 8 || err != ErrStagedFull {
+			t.Fatalf("Write() = (%d, %v), want (8, %v)", cnt, err, ErrStagedFull)
+		}
+		b.Commit()
+
+		// Once committed, a blocked writer makes progress as the reader drains.
+		done := make(chan error)
+		go func() {
+			_, err := b.Write([]byte("89"))
+			done <- err
+		}()
+		buf := make([]byte, 4)
+		if _, err := b.Read(buf); err != nil {
+			t.Fatalf("unexpected Read error: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("unexpected Write error: %v", err)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	for _, mode := range []int{RingPoll, RingPoll | SPSC} {
+		b := NewBufferPipe(make([]byte, 100), mode)
+		var events []bool
+		b.SetWatermarks(20, 80, func(high bool) { events = append(events, high) })
+
+		b.Write(make([]byte, 50)) // Length: 50
+		b.Write(make([]byte, 40)) // Length: 90; crossed high watermark
+		b.Read(make([]byte, 30))  // Length: 60
+		b.Write(make([]byte, 30)) // Length: 90
+		b.Read(make([]byte, 75))  // Length: 15; crossed low watermark
+		b.Write(make([]byte, 10)) // Length: 25
+		b.Write(make([]byte, 60)) // Length: 85; crossed high watermark
+		b.Read(make([]byte, 100)) // Length: 0; crossed low watermark
+
+		if want := []bool{true, false, true, false}; !reflect.DeepEqual(events, want) {
+			t.Errorf("watermark events = %v, want %v", events, want)
+		}
+		got := b.Stats()
+		if got.BytesWritten != 190 || got.BytesRead != 190 || got.WriteWait != 0 || got.ReadWait != 0 {
+			t.Errorf("Stats() = %+v, want {BytesWritten:190 BytesRead:190 WriteWait:0 ReadWait:0}", got)
+		}
+	}
+
+	// Blocking on an empty buffer is accounted for.
+	b := NewBufferPipe(make([]byte, 100), RingBlock)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.Close()
+	}()
+	b.Read(make([]byte, 1))
+	if got := b.Stats(); got.ReadWait < 10*time.Millisecond {
+		t.Errorf("Stats().ReadWait = %v, want at least %v", got.ReadWait, 10*time.Millisecond)
+	}
+}
+
+// blocks reports whether f blocks waiting on the pipe, in which case unblock
+// is called to allow f to return.
+func blocks(f, unblock func()) bool {
+	waiting := make(chan struct{}, 1)
+	testHookWait = func() {
+		select {
+		case waiting <- struct{}{}:
+		default:
+		}
+	}
+	defer func() { testHookWait = nil }()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+		return false
+	case <-waiting:
+		unblock()
+		<-done
+		return true
+	}
+}
+
+func TestModes(t *testing.T) {
+	tests := []struct {
+		mode       Mode
+		wantString string
+		monoRead   bool // Written data is only visible after Close
+		blockWrite bool // Writing to a full buffer blocks
+		blockRead  bool // Reading from an empty buffer blocks
+		ringWrite  bool // Reading data frees up buffer for writing
+	}{
+		{Line | Mono | PollI | PollO, "Line|Mono|PollI|PollO", true, false, false, false},
+		{Line | Mono | PollI | BlockO, "Line|Mono|PollI|BlockO", true, false, true, false},
+		{Line | Dual | PollI | PollO, "Line|Dual|PollI|PollO", false, false, false, false},
+		{Line | Dual | PollI | BlockO, "Line|Dual|PollI|BlockO", false, false, true, false},
+		{Ring | Dual | PollI | PollO, "Ring|Dual|PollI|PollO", false, false, false, true},
+		{Ring | Dual | PollI | BlockO, "Ring|Dual|PollI|BlockO", false, false, true, true},
+		{Ring | Dual | BlockI | PollO, "Ring|Dual|BlockI|PollO", false, true, false, true},
+		{Ring | Dual | BlockI | BlockO, "Ring|Dual|BlockI|BlockO", false, true, true, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.mode.String(); got != tt.wantString {
+			t.Errorf("Mode(%d).String() = %q, want %q", int(tt.mode), got, tt.wantString)
+		}
+		for _, mode := range []Mode{tt.mode, tt.mode | SPSC} {
+			newPipe := func() *BufferPipe {
+				b, err := New(make([]byte, 8), mode)
+				if err != nil {
+					t.Fatalf("unexpected New(%v) error: %v", mode, err)
+				}
+				return b
+			}
+
+			// Written data is visible to readers either immediately or only
+			// after the pipe is closed.
+			b := newPipe()
+			b.Write([]byte("abcdefgh"))
+			var got []byte
+			var err error
+			read := func() { got, _, err = b.ReadSlices() }
+			if tt.monoRead {
+				if blocks(read, func() { b.Close() }) != tt.blockRead {
+					t.Errorf("%v: ReadSlices blocking = %v, want %v", mode, !tt.blockRead, tt.blockRead)
+				}
+				if !tt.blockRead && (len(got) != 0 || err != io.ErrNoProgress) {
+					t.Errorf("%v: ReadSlices() = (%q, %v), want (\"\", %v)", mode, got, err, io.ErrNoProgress)
+				}
+				b.Close()
+				read()
+			} else {
+				read()
+			}
+			if string(got) != "abcdefgh" || err != nil {
+				t.Errorf("%v: ReadSlices() = (%q, %v), want (%q, nil)", mode, got, err, "abcdefgh")
+			}
+
+			// Writing to a full buffer either blocks or fails.
+			b = newPipe()
+			b.Write([]byte("abcdefgh"))
+			var cnt int
+			write := func() { cnt, err = b.Write([]byte("i")) }
+			if blocks(write, func() { b.Close() }) != tt.blockWrite {
+				t.Errorf("%v: Write blocking = %v, want %v", mode, !tt.blockWrite, tt.blockWrite)
+			}
+			if wantErr := io.ErrShortWrite; !tt.blockWrite && (cnt != 0 || err != wantErr) {
+				t.Errorf("%v: Write() = (%d, %v), want (0, %v)", mode, cnt, err, wantErr)
+			}
+
+			// Reading from an empty buffer either blocks or fails.
+			b = newPipe()
+			if blocks(read, func() { b.Close() }) != tt.blockRead {
+				t.Errorf("%v: ReadSlices blocking = %v, want %v", mode, !tt.blockRead, tt.blockRead)
+			}
+			if wantErr := io.ErrNoProgress; !tt.blockRead && (len(got) != 0 || err != wantErr) {
+				t.Errorf("%v: ReadSlices() = (%q, %v), want (\"\", %v)", mode, got, err, wantErr)
+			}
+
+			// Reading data either frees up buffer for writing or has no effect.
+			if tt.monoRead {
+				continue
+			}
+			b = newPipe()
+			b.Write([]byte("abcdefgh"))
+			b.Read(make([]byte, 4))
+			wantCnt := 0
+			if tt.ringWrite {
+				wantCnt = 4
+			}
+			bufLo, bufHi, _ := b.WriteSlices()
+			if cnt := len(bufLo) + len(bufHi); cnt != wantCnt {
+				t.Errorf("%v: WriteSlices() available = %d, want %d", mode, cnt, wantCnt)
+			}
+		}
+	}
+}
+
+func TestModeValidate(t *testing.T) {
+	tests := []struct {
+		mode    Mode
+		wantErr bool
+	}{
+		{LineMono, false},
+		{LineDual, false},
+		{RingPoll, false},
+		{RingBlock | SPSC | Staged, false},
+		{Ring | Mono | PollI | PollO, true},
+		{Ring | Mono | BlockI | BlockO, true},
+		{Line | Dual | BlockI | BlockO, true},
+		{LineMono | BlockI, true},
+		{RingBlock | 1<<10, true},
+	}
+	for _, tt := range tests {
+		_, err := New(nil, tt.mode)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("New(nil, %v) error = %v, want error %v", tt.mode, err, tt.wantErr)
+		}
+	}
+	if got, want := Mode(RingBlock|SPSC|1<<10).String(), "Ring|Dual|BlockI|BlockO|SPSC|Mode(0x400)"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	errReader := errors.New("reader error")
+	errWriter := errors.New("writer error")
+
+	// Closing the write half with an error is seen by readers after draining.
+	r, w := NewPipe(make([]byte, 4))
+	go func() {
+		w.Write([]byte("hello, world"))
+		w.CloseWithError(errWriter)
+	}()
+	got, err := ioutil.ReadAll(r)
+	if string(got) != "hello, world" || err != errWriter {
+		t.Errorf("ReadAll() = (%q, %v), want (%q, %v)", got, err, "hello, world", errWriter)
+	}
+	if _, err := w.Write([]byte("#")); err != io.ErrClosedPipe {
+		t.Errorf("Write() after Close = %v, want %v", err, io.ErrClosedPipe)
+	}
+
+	// Closing the read half with an error is seen by blocked writers.
+	r, w = NewPipe(make([]byte, 4))
+	go func() {
+		r.Read(make([]byte, 2))
+		r.CloseWithError(errReader)
+	}()
+	cnt, err := w.Write([]byte("hello, world"))
+	if cnt < 4 || cnt > 6 || err != errReader {
+		t.Errorf("Write() = (%d, %v), want (4..6, %v)", cnt, err, errReader)
+	}
+	if cnt, err := r.Read(make([]byte, 2)); cnt != 0 || err != io.ErrClosedPipe {
+		t.Errorf("Read() after Close = (%d, %v), want (0, %v)", cnt, err, io.ErrClosedPipe)
+	}
+	w.CloseWithError(errWriter) // Does not override the error for readers
+	if _, err := w.Write([]byte("#")); err != errReader {
+		t.Errorf("Write() after Close = %v, want %v", err, errReader)
+	}
+
+	// Reads return partial data without waiting for the buffer to be filled.
+	r, w = NewPipe(make([]byte, 64))
+	w.Write([]byte("abc"))
+	if cnt, err := r.Read(make([]byte, 10)); cnt != 3 || err != nil {
+		t.Errorf("Read() = (%d, %v), want (3, nil)", cnt, err)
+	}
+	w.Close()
+	if cnt, err := r.Read(make([]byte, 10)); cnt != 0 || err != io.EOF {
+		t.Errorf("Read() = (%d, %v), want (0, %v)", cnt, err, io.EOF)
+	}
+}
+
+func TestPipeConcurrentClose(t *testing.T) {
+	// Closing a half between obtaining slices and marking them does not panic.
+	r, w := NewPipe(make([]byte, 8))
+	w.Write([]byte("abcd"))
+	bufLo, _, _ := r.ReadSlices()
+	r.Close()
+	if err := r.ReadMark(len(bufLo)); err != io.ErrClosedPipe {
+		t.Errorf("ReadMark() = %v, want %v", err, io.ErrClosedPipe)
+	}
+
+	r, w = NewPipe(make([]byte, 8))
+	bufLo, _, _ = w.WriteSlices()
+	r.Close()
+	if err := w.WriteMark(len(bufLo)); err != io.ErrClosedPipe {
+		t.Errorf("WriteMark() = %v, want %v", err, io.ErrClosedPipe)
+	}
+
+	// Closing either half while reads and writes are in progress does not
+	// panic, and causes both routines to return.
+	for i := 0; i < 100; i++ {
+		r, w := NewPipe(make([]byte, 8))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				if _, err := w.Write([]byte("hello, world")); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			for j := 0; j < i; j++ {
+				r.Read(make([]byte, 5))
+			}
+			if i%2 == 0 {
+				r.Close()
+			} else {
+				w.Close()
+			}
+		}()
+		for {
+			if _, err := r.Read(make([]byte, 5)); err != nil {
+				break
+			}
+		}
+		<-done
+	}
+}
+
+func TestVectoredIO(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(0)).Read(data)
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	go func() {
+		defer pw.Close()
+		pw.Write(data)
+	}()
+
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// The ring buffer is intentionally not a power of two in size so that
+	// reads and writes frequently straddle the wrap around point.
+	b := NewBufferPipe(make([]byte, 5000), RingBlock)
+	go func() {
+		cnt, err := b.ReadFrom(pr)
+		if cnt != int64(len(data)) || err != nil {
+			t.Errorf("ReadFrom() = (%d, %v), want (%d, nil)", cnt, err, len(data))
+		}
+		b.Close()
+	}()
+	cnt, err := b.WriteToConn(f)
+	if cnt != int64(len(data)) || err != nil {
+		t.Errorf("WriteToConn() = (%d, %v), want (%d, nil)", cnt, err, len(data))
+	}
+
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("mismatching data:\ngot  %d bytes\nwant %d bytes", len(got), len(data))
+	}
+}
+
+func TestVectoredIOClose(t *testing.T) {
+	// Closing the pipe while ReadFrom is blocked in readv does not panic.
+	for _, mode := range []int{RingBlock, RingBlock | SPSC} {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := NewBufferPipe(make([]byte, 64), mode)
+		done := make(chan error)
+		go func() {
+			_, err := b.ReadFrom(pr)
+			done <- err
+		}()
+		pw.Write([]byte("a"))
+		for b.Length() == 0 {
+			time.Sleep(time.Millisecond) // Wait until ReadFrom is back in readv
+		}
+		b.Close()
+		pw.Write([]byte("b"))
+		if err := <-done; err != io.ErrClosedPipe {
+			t.Errorf("ReadFrom() = %v, want %v", err, io.ErrClosedPipe)
+		}
+		pr.Close()
+		pw.Close()
+	}
+
+	// Closing the read half while WriteTo is blocked in writev does not panic.
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w := NewPipe(make([]byte, 1<<20))
+	w.Write(make([]byte, 1<<20)) // Larger than the capacity of an OS pipe
+	done := make(chan error)
+	go func() {
+		_, err := r.WriteTo(pw)
+		done <- err
+	}()
+	if _, err := io.ReadFull(pr, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	go io.Copy(ioutil.Discard, pr)
+	if err := <-done; err != io.ErrClosedPipe {
+		t.Errorf("WriteTo() = %v, want %v", err, io.ErrClosedPipe)
+	}
+	pr.Close()
+	pw.Close()
+}
+
+func TestPool(t *testing.T) {
+	panics := func(f func()) (panicked bool) {
+		defer func() { panicked = recover() != nil }()
+		f()
+		return false
+	}
+
+	if _, err := NewPool(64, Ring|Mono, false); err == nil {
+		t.Errorf("NewPool with illogical mode did not fail")
+	}
+	if _, err := NewPool(-1, RingBlock, false); err == nil {
+		t.Errorf("NewPool with negative size did not fail")
+	}
+
+	for _, debug := range []bool{false, true} {
+		p, err := NewPool(64, RingBlock, debug)
+		if err != nil {
+			t.Fatalf("unexpected NewPool error: %v", err)
+		}
+		for i := 0; i < 10; i++ {
+			b := p.Get()
+			if b.Capacity() != 64 || b.Mode() != RingBlock || b.Length() != 0 {
+				t.Fatalf("Get() = {Capacity: %d, Mode: %v, Length: %d}, want {64, %v, 0}", b.Capacity(), Mode(b.Mode()), b.Length(), Mode(RingBlock))
+			}
+			testStream(t, b, bytes.Repeat([]byte("abc"), 100))
+			if !p.Put(b) {
+				t.Fatalf("Put of drained BufferPipe did not reclaim it")
+			}
+
+			// Every method panics after release, not just those that happen
+			// to observe the closed pipe.
+			for name, f := range map[string]func(){
+				"Write":    func() { b.Write([]byte("abc")) },
+				"Read":     func() { b.Read(nil) },
+				"Length":   func() { b.Length() },
+				"Capacity": func() { b.Capacity() },
+				"Commit":   func() { b.Commit() },
+				"Rollback": func() { b.Rollback() },
+				"Close":    func() { b.Close() },
+				"Reset":    func() { b.Reset() },
+			} {
+				if !panics(f) {
+					t.Errorf("%s after Put did not panic", name)
+				}
+			}
+		}
+
+		// An undrained pipe is left for the reader and reclaimed once drained.
+		b := p.Get()
+		b.Write([]byte("abc"))
+		b.Close()
+		if p.Put(b) {
+			t.Errorf("Put of undrained BufferPipe reclaimed it")
+		}
+		if got, err := ioutil.ReadAll(b); string(got) != "abc" || err != nil {
+			t.Errorf("ReadAll() = (%q, %v), want (%q, nil)", got, err, "abc")
+		}
+		if !p.Put(b) {
+			t.Errorf("Put of drained BufferPipe did not reclaim it")
+		}
+
+		b = p.Get()
+		if !panics(func() { p.Put(b) }) {
+			t.Errorf("Put before Close did not panic")
+		}
+		if !panics(func() { p.Put(NewBufferPipe(nil, RingBlock)) }) {
+			t.Errorf("Put of foreign BufferPipe did not panic")
+		}
+		b.Close()
+		p.Put(b)
+		if !panics(func() { p.Put(b) }) {
+			t.Errorf("repeated Put did not panic")
+		}
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright 2014, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+//go:build go1.18
+// +build go1.18
+
+package bufpipe
+
+import "testing"
+
+func FuzzModel(f *testing.F) {
+	f.Add(byte(0), byte(8), []byte("\x00\x04\x02\x02\x07\x00\x02\x05"))
+	f.Add(byte(31), byte(8), []byte("\x00\x06\x04\x00\x01\x03\x06\x05\x03\x01"))
+	f.Fuzz(func(t *testing.T, mode, size byte, ops []byte) {
+		testModel(t, testModes[int(mode)%len(testModes)], 1+int(size)%64, ops)
+	})
+}
@@ -0,0 +1,71 @@
+// Copyright 2014, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package bufpipe
+
+import "os"
+import "errors"
+
+var errNoMmap = errors.New("bufpipe: memory mapping is not supported on this platform")
+
+// NewFileBufferPipe creates a BufferPipe whose internal buffer is the first
+// size bytes of the given file, mapped into memory, rather than heap memory.
+// This allows a pipe to hold far more data than would be reasonable to keep
+// on the heap. The file is grown to size bytes if it is smaller.
+//
+// The pipe supports the same modes of operation as NewBufferPipe, and slices
+// returned by WriteSlices and ReadSlices directly alias the mapped file.
+// Since slices must alias the backing store, an arbitrary io.ReaderAt and
+// io.WriterAt cannot be used; only memory mappable files are supported.
+// Memory mapping is currently only implemented on Linux. On other platforms,
+// this reports an error rather than silently buffering the file on the heap.
+//
+// The mapping remains valid even if f is closed. Call Unmap to release it
+// once the pipe is no longer in use.
+func NewFileBufferPipe(f *os.File, size int, mode int) (*BufferPipe, error) {
+	if size < 0 {
+		return nil, errors.New("bufpipe: negative buffer size")
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < int64(size) {
+		if err := f.Truncate(int64(size)); err != nil {
+			return nil, err
+		}
+	}
+
+	b := NewBufferPipe(nil, mode)
+	if size > 0 { // Zero-length mappings are invalid
+		buf, err := mmapFile(f, size)
+		if err != nil {
+			return nil, err
+		}
+		b.buf = buf
+		b.unmap = func() error { return munmapFile(buf) }
+	}
+	return b, nil
+}
+
+// Unmap releases the memory mapping backing the pipe, if any.
+// It has no effect on pipes that use a caller-provided buffer.
+//
+// The pipe is closed and has no capacity afterwards. All slices previously
+// obtained from WriteSlices, ReadSlices, or Buffer become invalid and
+// must not be accessed.
+func (b *BufferPipe) Unmap() error {
+	b.checkFreed()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.unmap == nil {
+		return nil
+	}
+	err := b.unmap()
+	b.buf, b.vbuf, b.unmap = nil, nil, nil
+	b.setClosed(true)
+	b.rdCond.Broadcast()
+	b.wrCond.Broadcast()
+	return err
+}
@@ -0,0 +1,24 @@
+// Copyright 2014, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+//go:build linux
+// +build linux
+
+package bufpipe
+
+import "os"
+import "syscall"
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	prot := syscall.PROT_READ | syscall.PROT_WRITE
+	buf, err := syscall.Mmap(int(f.Fd()), 0, size, prot, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, os.NewSyscallError("mmap", err)
+	}
+	return buf, nil
+}
+
+func munmapFile(buf []byte) error {
+	return os.NewSyscallError("munmap", syscall.Munmap(buf))
+}
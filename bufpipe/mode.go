@@ -0,0 +1,70 @@
+// Copyright 2014, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package bufpipe
+
+import "fmt"
+import "strings"
+
+// Mode is the mode of operation of a BufferPipe, which is the bitwise OR of
+// the flags defined above. Since the flags are untyped constants, they may be
+// used both as a Mode and as an int for NewBufferPipe.
+type Mode int
+
+const allFlags = Ring | Dual | BlockI | BlockO | SPSC | Staged
+
+var flagNames = []struct {
+	flag       Mode
+	set, unset string
+}{
+	{Ring, "Ring", "Line"},
+	{Dual, "Dual", "Mono"},
+	{BlockI, "BlockI", "PollI"},
+	{BlockO, "BlockO", "PollO"},
+	{SPSC, "SPSC", ""},
+	{Staged, "Staged", ""},
+}
+
+// String formats the mode as the bitwise OR of its flag names
+// (e.g., "Ring|Dual|BlockI|BlockO").
+func (m Mode) String() string {
+	var ss []string
+	for _, f := range flagNames {
+		switch {
+		case m&f.flag > 0:
+			ss = append(ss, f.set)
+		case f.unset != "":
+			ss = append(ss, f.unset)
+		}
+	}
+	if m&^allFlags != 0 {
+		ss = append(ss, fmt.Sprintf("Mode(%#x)", int(m&^allFlags)))
+	}
+	return strings.Join(ss, "|")
+}
+
+// Validate reports an error if the mode contains unknown flags or is one of
+// the illogical combinations of flags, which are Ring with Mono and
+// Line with BlockI.
+func (m Mode) Validate() error {
+	switch {
+	case m&^allFlags != 0:
+		return fmt.Errorf("bufpipe: invalid mode %v: unknown flags", m)
+	case m&Ring > 0 && m&Dual == 0:
+		return fmt.Errorf("bufpipe: illogical mode %v: Ring with Mono is effectively Line with Mono", m)
+	case m&Ring == 0 && m&BlockI > 0:
+		return fmt.Errorf("bufpipe: illogical mode %v: Line with BlockI blocks forever once the buffer is full", m)
+	}
+	return nil
+}
+
+// New is like NewBufferPipe, but only accepts one of the 8 logical
+// combinations of flags (optionally combined with SPSC or Staged).
+// It reports an error for any other mode.
+func New(buf []byte, mode Mode) (*BufferPipe, error) {
+	if err := mode.Validate(); err != nil {
+		return nil, err
+	}
+	return NewBufferPipe(buf, int(mode)), nil
+}
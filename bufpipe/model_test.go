@@ -0,0 +1,402 @@
+// Copyright 2014, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package bufpipe
+
+import "io"
+import "fmt"
+import "bytes"
+import "testing"
+import "runtime"
+import "math/rand"
+import "sync/atomic"
+
+// The 8 logical modes combined with the optional implementation flags.
+var testModes = func() (modes []int) {
+	for _, mode := range []int{
+		Line | Mono | PollI | PollO, Line | Mono | PollI | BlockO,
+		Line | Dual | PollI | PollO, Line | Dual | PollI | BlockO,
+		Ring | Dual | PollI | PollO, Ring | Dual | PollI | BlockO,
+		Ring | Dual | BlockI | PollO, Ring | Dual | BlockI | BlockO,
+	} {
+		modes = append(modes, mode, mode|SPSC, mode|Staged, mode|SPSC|Staged)
+	}
+	return modes
+}()
+
+// model is a reference model of a BufferPipe.
+type model struct {
+	mode       int
+	size       int
+	rd, cm, wr int64
+	closed     bool
+	stream     []byte // stream[i] is the byte at absolute position i
+}
+
+func (m *model) avail() int {
+	switch {
+	case m.closed:
+		return 0
+	case m.mode&Ring > 0:
+		return m.size - int(m.wr-m.rd)
+	default:
+		return m.size - int(m.wr)
+	}
+}
+
+func (m *model) valid() int {
+	if m.mode&Dual == 0 && !m.closed {
+		return 0
+	}
+	return int(m.cm - m.rd)
+}
+
+func (m *model) write(data []byte) {
+	m.stream = append(m.stream[:m.wr], data...)
+	m.wr += int64(len(data))
+	if m.mode&Staged == 0 {
+		m.cm = m.wr
+	}
+}
+
+// opReader produces values from a sequence of operation bytes.
+type opReader []byte
+
+func (r *opReader) next() int {
+	if len(*r) == 0 {
+		return 0
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return int(v)
+}
+
+// testModel performs the sequence of operations encoded in ops upon both a
+// BufferPipe and a reference model, and verifies that they behave identically.
+// Operations that would block forever are skipped.
+func testModel(t *testing.T, mode, size int, ops []byte) {
+	b := NewBufferPipe(make([]byte, size), mode)
+	m := &model{mode: mode, size: size}
+	isBlockI := mode&BlockI > 0
+	isBlockO := mode&BlockO > 0
+
+	var cnt byte
+	newData := func(n int) []byte {
+		data := make([]byte, n)
+		for i := range data {
+			cnt++
+			data[i] = cnt
+		}
+		return data
+	}
+	readSlices := func() []byte {
+		bufLo, bufHi, err := b.ReadSlices()
+		var wantErr error
+		switch {
+		case m.valid() > 0:
+		case m.closed:
+			wantErr = io.EOF
+		default:
+			wantErr = io.ErrNoProgress
+		}
+		got := append(append([]byte(nil), bufLo...), bufHi...)
+		want := m.stream[m.rd : m.rd+int64(m.valid())]
+		if !bytes.Equal(got, want) || err != wantErr {
+			t.Fatalf("%v: ReadSlices() = (%x, %v), want (%x, %v)", Mode(mode), got, err, want, wantErr)
+		}
+		return got
+	}
+
+	r := opReader(ops)
+	for i := 0; len(r) > 0; i++ {
+		switch op := r.next() % 9; op {
+		case 0: // Write
+			n := r.next() % (size + 2)
+			if isBlockI && n > m.avail() && !m.closed {
+				continue
+			}
+			data := newData(n)
+			gotCnt, gotErr := b.Write(data)
+			wantCnt, wantErr := n, error(nil)
+			if n > m.avail() {
+				wantCnt, wantErr = m.avail(), io.ErrShortWrite
+				if m.closed {
+					wantErr = io.ErrClosedPipe
+				}
+			}
+			if gotCnt != wantCnt || gotErr != wantErr {
+				t.Fatalf("%v: op %d, Write(%d) = (%d, %v), want (%d, %v)", Mode(mode), i, n, gotCnt, gotErr, wantCnt, wantErr)
+			}
+			m.write(data[:wantCnt])
+		case 1: // WriteSlices and WriteMark
+			if isBlockI && m.avail() == 0 && !m.closed {
+				continue
+			}
+			bufLo, bufHi, err := b.WriteSlices()
+			var wantErr error
+			switch {
+			case m.avail() > 0:
+			case m.closed:
+				wantErr = io.ErrClosedPipe
+			default:
+				wantErr = io.ErrShortWrite
+			}
+			if len(bufLo)+len(bufHi) != m.avail() || err != wantErr {
+				t.Fatalf("%v: op %d, WriteSlices() = (%d, %d, %v), want %d bytes and %v", Mode(mode), i, len(bufLo), len(bufHi), err, m.avail(), wantErr)
+			}
+			if len(bufLo) == 0 && len(bufHi) > 0 {
+				t.Fatalf("%v: op %d, WriteSlices() returned empty first slice", Mode(mode), i)
+			}
+			n := r.next() % (m.avail() + 1)
+			data := newData(n)
+			copy(bufHi, data[copy(bufLo, data):])
+			if isBlockI && m.avail() == 0 {
+				continue
+			}
+			b.WriteMark(n)
+			m.write(data)
+		case 2: // Read
+			n := r.next() % (size + 2)
+			if isBlockO && n > m.valid() && !m.closed {
+				continue
+			}
+			data := make([]byte, n)
+			gotCnt, gotErr := b.Read(data)
+			wantCnt, wantErr := n, error(nil)
+			if n > m.valid() {
+				wantCnt, wantErr = m.valid(), io.ErrNoProgress
+				if m.closed {
+					wantErr = io.EOF
+				}
+			}
+			want := m.stream[m.rd : m.rd+int64(wantCnt)]
+			if gotCnt != wantCnt || gotErr != wantErr || !bytes.Equal(data[:gotCnt], want) {
+				t.Fatalf("%v: op %d, Read(%d) = (%x, %v), want (%x, %v)", Mode(mode), i, n, data[:gotCnt], gotErr, want, wantErr)
+			}
+			m.rd += int64(wantCnt)
+		case 3: // ReadSlices and ReadMark
+			if isBlockO && m.valid() == 0 && !m.closed {
+				continue
+			}
+			readSlices()
+			if isBlockO && m.valid() == 0 {
+				continue
+			}
+			n := r.next() % (m.valid() + 1)
+			b.ReadMark(n)
+			m.rd += int64(n)
+		case 4: // Rollback
+			var want int64
+			switch {
+			case m.closed:
+			case mode&Staged > 0:
+				want = m.wr - m.cm
+				m.wr = m.cm
+			case mode&Dual == 0:
+				want = m.wr - m.rd
+				m.wr, m.cm = m.rd, m.rd
+			}
+			if got := b.Rollback(); got != int(want) {
+				t.Fatalf("%v: op %d, Rollback() = %d, want %d", Mode(mode), i, got, want)
+			}
+		case 5: // Commit
+			var want int64
+			if !m.closed {
+				want = m.wr - m.cm
+				m.cm = m.wr
+			}
+			if got := b.Commit(); got != int(want) {
+				t.Fatalf("%v: op %d, Commit() = %d, want %d", Mode(mode), i, got, want)
+			}
+		case 6: // StagedSlices
+			bufLo, bufHi := b.StagedSlices()
+			if len(bufLo)+len(bufHi) != int(m.wr-m.cm) {
+				t.Fatalf("%v: op %d, StagedSlices() = (%d, %d), want %d bytes", Mode(mode), i, len(bufLo), len(bufHi), m.wr-m.cm)
+			}
+			data := newData(len(bufLo) + len(bufHi))
+			copy(bufHi, data[copy(bufLo, data):])
+			copy(m.stream[m.cm:m.wr], data)
+		case 7: // Close
+			if r.next()%4 > 0 {
+				continue // Close less frequently to allow more operations
+			}
+			b.Close()
+			m.closed = true
+		case 8: // Reset
+			if r.next()%4 > 0 {
+				continue // Reset less frequently to allow more operations
+			}
+			b.Reset()
+			*m = model{mode: mode, size: size}
+		}
+
+		// Check pointer invariants and the contents of the buffer.
+		rd, wr := b.Pointers()
+		cm := atomic.LoadInt64(&b.cmPtr)
+		if rd != m.rd || cm != m.cm || wr != m.wr {
+			t.Fatalf("%v: op %d, pointers = (%d, %d, %d), want (%d, %d, %d)", Mode(mode), i, rd, cm, wr, m.rd, m.cm, m.wr)
+		}
+		if !(0 <= rd && rd <= cm && cm <= wr) || m.avail() < 0 {
+			t.Fatalf("%v: op %d, invalid pointers (%d, %d, %d)", Mode(mode), i, rd, cm, wr)
+		}
+		if got, want := b.Length(), int(m.cm-m.rd); got != want {
+			t.Fatalf("%v: op %d, Length() = %d, want %d", Mode(mode), i, got, want)
+		}
+		bufLo, bufHi := b.slices(m.rd, int(m.wr-m.rd))
+		if got, want := append(append([]byte(nil), bufLo...), bufHi...), m.stream[m.rd:m.wr]; !bytes.Equal(got, want) {
+			t.Fatalf("%v: op %d, buffer contents = %x, want %x", Mode(mode), i, got, want)
+		}
+	}
+}
+
+func TestModel(t *testing.T) {
+	for _, mode := range testModes {
+		for seed := int64(0); seed < 50; seed++ {
+			rand := rand.New(rand.NewSource(seed))
+			ops := make([]byte, 1000)
+			rand.Read(ops)
+			testModel(t, mode, 1+rand.Intn(32), ops)
+		}
+	}
+}
+
+// TestStress concurrently writes and reads a stream of data through the pipe
+// using a random mixture of operations in every mode that allows concurrent
+// reads and writes, and verifies the integrity of the stream.
+func TestStress(t *testing.T) {
+	const streamSize = 1 << 18
+	streamByte := func(i int64) byte { return byte(i) ^ byte(i>>8) ^ byte(i>>16) }
+
+	for _, mode := range testModes {
+		if mode&Dual == 0 {
+			continue
+		}
+		// Each mode uses a fixed seed such that failures are reproducible.
+		seed := int64(mode)
+		size := 1 + rand.New(rand.NewSource(seed)).Intn(4096)
+		if mode&Ring == 0 {
+			size = 2 * streamSize // Line mode needs space for the garbage data
+		}
+		name := fmt.Sprintf("%v (seed %d, size %d)", Mode(mode), seed, size)
+		b := NewBufferPipe(make([]byte, size), mode)
+		done := make(chan struct{})
+		var stop int32 // Set when the consumer fails and the producer must stop
+
+		// The consumer stops the producer and waits for it before failing,
+		// draining the pipe such that a blocked producer can observe the stop.
+		fatalf := func(format string, args ...interface{}) {
+			t.Helper()
+			atomic.StoreInt32(&stop, 1)
+			for {
+				select {
+				case <-done:
+					t.Fatalf(format, args...)
+				default:
+					b.Read(make([]byte, size))
+					runtime.Gosched()
+				}
+			}
+		}
+
+		// Producer routine.
+		go func() {
+			defer close(done)
+			defer b.Close()
+			rand := rand.New(rand.NewSource(seed + 1))
+			retry := func(err error) bool {
+				b.Commit() // Garbage is only ever written after a commit
+				if err == io.ErrShortWrite {
+					runtime.Gosched() // Poll mode
+					return true
+				}
+				if err != nil {
+					t.Errorf("%s: unexpected write error: %v", name, err)
+				}
+				return false
+			}
+			for pos := int64(0); pos < streamSize && atomic.LoadInt32(&stop) == 0; {
+				// Occasionally write garbage and roll it back.
+				if mode&Staged > 0 && rand.Intn(4) == 0 {
+					b.Write(bytes.Repeat([]byte{0xff}, rand.Intn(size/4+1)))
+					b.Rollback()
+				}
+
+				n := 1 + rand.Intn(size/2+1)
+				if n > streamSize-int(pos) {
+					n = streamSize - int(pos)
+				}
+				if rand.Intn(2) == 0 {
+					data := make([]byte, n)
+					for i := range data {
+						data[i] = streamByte(pos + int64(i))
+					}
+					cnt, err := b.Write(data)
+					pos += int64(cnt)
+					if retry(err) {
+						continue
+					}
+				} else {
+					bufLo, bufHi, err := b.WriteSlices()
+					if retry(err) {
+						continue
+					}
+					cnt := 0
+					for _, buf := range [][]byte{bufLo, bufHi} {
+						for i := range buf {
+							if cnt < n {
+								buf[i] = streamByte(pos + int64(cnt))
+								cnt++
+							}
+						}
+					}
+					b.WriteMark(cnt)
+					pos += int64(cnt)
+					b.Commit()
+				}
+			}
+		}()
+
+		// Consumer routine.
+		rand := rand.New(rand.NewSource(seed + 2))
+		var pos int64
+		for {
+			var got []byte
+			var err error
+			if rand.Intn(2) == 0 {
+				got = make([]byte, 1+rand.Intn(size/2+1))
+				var cnt int
+				cnt, err = b.Read(got)
+				got = got[:cnt]
+			} else {
+				var bufLo, bufHi []byte
+				bufLo, bufHi, err = b.ReadSlices()
+				got = append(append([]byte(nil), bufLo...), bufHi...)
+				b.ReadMark(len(got))
+			}
+			for i, c := range got {
+				if want := streamByte(pos + int64(i)); c != want {
+					fatalf("%s: stream byte %d = %#x, want %#x", name, pos+int64(i), c, want)
+				}
+			}
+			pos += int64(len(got))
+
+			rd, wr := b.Pointers()
+			if rd != pos || (mode&Ring > 0 && wr-rd > int64(size)) {
+				fatalf("%s: invalid pointers (%d, %d) at stream position %d", name, rd, wr, pos)
+			}
+
+			if err == io.EOF {
+				break
+			} else if err == io.ErrNoProgress {
+				runtime.Gosched() // Poll mode
+			} else if err != nil {
+				fatalf("%s: unexpected read error: %v", name, err)
+			}
+		}
+		<-done
+		if pos != streamSize {
+			t.Fatalf("%s: read %d bytes, want %d bytes", name, pos, streamSize)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2014, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package bufpipe
+
+import "io"
+
+// PipeReader is the read half of a pipe created by NewPipe.
+type PipeReader struct{ b *BufferPipe }
+
+// PipeWriter is the write half of a pipe created by NewPipe.
+type PipeWriter struct{ b *BufferPipe }
+
+// NewPipe creates a buffered pipe with semantics similar to io.Pipe, where the
+// read and write halves are separate objects. Unlike io.Pipe, a write only
+// blocks until the data has been copied into the internal buffer, rather than
+// until a reader has consumed the data.
+//
+// The pipe is backed by a BufferPipe operating in RingBlock mode over buf.
+// It is safe to call methods on either half in parallel with each other.
+func NewPipe(buf []byte) (*PipeReader, *PipeWriter) {
+	b := NewBufferPipe(buf, RingBlock)
+	return &PipeReader{b}, &PipeWriter{b}
+}
+
+// Read reads data from the pipe, blocking until some data is available,
+// the write half is closed, or the read half is closed.
+// Unlike BufferPipe.Read, it does not block until len(data) bytes are read.
+//
+// Once the write half is closed with an error, Read returns that error after
+// all buffered data has been read. If the error is nil, then it returns io.EOF.
+// Once the read half is closed, Read returns io.ErrClosedPipe.
+func (r *PipeReader) Read(data []byte) (cnt int, err error) {
+	b := r.b
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	bufLo, bufHi, err := b.readSlices()
+	cnt = copy(data, bufLo)
+	cnt += copy(data[cnt:], bufHi)
+	b.readMark(cnt)
+	return cnt, err
+}
+
+// ReadSlices is equivalent to BufferPipe.ReadSlices.
+func (r *PipeReader) ReadSlices() (bufLo, bufHi []byte, err error) {
+	return r.b.ReadSlices()
+}
+
+// ReadMark is equivalent to BufferPipe.ReadMark, except that if the read half
+// was closed since the slices were obtained, it reports io.ErrClosedPipe
+// rather than panicking.
+func (r *PipeReader) ReadMark(cnt int) error {
+	return r.b.readMarkErr(cnt)
+}
+
+// WriteTo is equivalent to BufferPipe.WriteTo.
+func (r *PipeReader) WriteTo(wr io.Writer) (cnt int64, err error) {
+	return r.b.WriteTo(wr)
+}
+
+// Close closes the read half of the pipe.
+// Subsequent writes to the write half return io.ErrClosedPipe.
+func (r *PipeReader) Close() error {
+	return r.CloseWithError(nil)
+}
+
+// CloseWithError closes the read half of the pipe.
+// Subsequent writes to the write half return err, or io.ErrClosedPipe if err
+// is nil. It never overwrites a previous error and always returns nil.
+func (r *PipeReader) CloseWithError(err error) error {
+	r.b.closeRead(err)
+	return nil
+}
+
+// Write writes data to the pipe, blocking until all of the data is buffered,
+// the read half is closed, or the write half is closed.
+//
+// Once the read half is closed with an error, Write returns that error.
+// If the error is nil, then it returns io.ErrClosedPipe.
+// Once the write half is closed, Write returns io.ErrClosedPipe.
+func (w *PipeWriter) Write(data []byte) (cnt int, err error) {
+	return w.b.Write(data)
+}
+
+// WriteSlices is equivalent to BufferPipe.WriteSlices.
+func (w *PipeWriter) WriteSlices() (bufLo, bufHi []byte, err error) {
+	return w.b.WriteSlices()
+}
+
+// WriteMark is equivalent to BufferPipe.WriteMark, except that if either half
+// was closed since the slices were obtained, it discards the data and reports
+// the same error that Write would rather than panicking.
+func (w *PipeWriter) WriteMark(cnt int) error {
+	return w.b.writeMarkErr(cnt)
+}
+
+// ReadFrom is equivalent to BufferPipe.ReadFrom.
+func (w *PipeWriter) ReadFrom(rd io.Reader) (cnt int64, err error) {
+	return w.b.ReadFrom(rd)
+}
+
+// Close closes the write half of the pipe.
+// Subsequent reads from the read half return io.EOF once the buffered data
+// has been read.
+func (w *PipeWriter) Close() error {
+	return w.CloseWithError(nil)
+}
+
+// CloseWithError closes the write half of the pipe.
+// Subsequent reads from the read half return err, or io.EOF if err is nil,
+// once the buffered data has been read.
+// It never overwrites a previous error and always returns nil.
+func (w *PipeWriter) CloseWithError(err error) error {
+	w.b.closeWrite(err)
+	return nil
+}
+
+// Closes the read half, such that writers observe err.
+func (b *BufferPipe) closeRead(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err == nil {
+		err = io.ErrClosedPipe
+	}
+	if b.wrErr == nil {
+		b.wrErr = err
+	}
+	b.rdDone = true
+	b.setClosed(true)
+	b.rdCond.Broadcast()
+	b.wrCond.Broadcast()
+}
+
+// Closes the write half, such that readers observe err after draining.
+func (b *BufferPipe) closeWrite(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.err == nil {
+		b.err = err
+	}
+	if b.wrErr == nil {
+		b.wrErr = io.ErrClosedPipe
+	}
+	b.setClosed(true)
+	b.rdCond.Broadcast()
+	b.wrCond.Broadcast()
+}
@@ -0,0 +1,98 @@
+// Copyright 2014, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package bufpipe
+
+import "sync"
+import "errors"
+import "sync/atomic"
+
+// Pool is a set of reusable BufferPipes that all have the same capacity and
+// mode of operation. It avoids allocating a new internal buffer for every pipe
+// when many short-lived pipes are needed. It is safe for concurrent use.
+type Pool struct {
+	size  int
+	mode  Mode
+	debug bool
+	pool  sync.Pool
+}
+
+// NewPool creates a Pool of BufferPipes, each with an internal buffer of size
+// bytes and operating in the given mode. Like New, it reports an error if the
+// mode is not one of the logical combinations of flags.
+//
+// Calling any method on a released pipe panics, but only until the pool hands
+// it out again.
+// In debug mode, a pipe released to the pool is never handed out again.
+// Instead, its internal buffer is moved to a new pipe and the released pipe is
+// poisoned such that any subsequent use of it always panics. This reliably
+// detects uses after release at the cost of allocating a new BufferPipe for
+// each call to Get.
+func NewPool(size int, mode Mode, debug bool) (*Pool, error) {
+	if size < 0 {
+		return nil, errors.New("bufpipe: negative buffer size")
+	}
+	if err := mode.Validate(); err != nil {
+		return nil, err
+	}
+	return &Pool{size: size, mode: mode, debug: debug}, nil
+}
+
+// Get returns a BufferPipe from the pool, allocating a new one if necessary.
+// The returned pipe is in the same state as a newly created pipe.
+func (p *Pool) Get() *BufferPipe {
+	if b, _ := p.pool.Get().(*BufferPipe); b != nil {
+		b.mutex.Lock()
+		b.reset()
+		b.mutex.Unlock()
+		atomic.StoreInt32(&b.freed, 0)
+		return b
+	}
+	b := NewBufferPipe(make([]byte, p.size), int(p.mode))
+	b.pool = p
+	return b
+}
+
+// Put releases a BufferPipe obtained from Get back to the pool and reports
+// whether it was reclaimed. The pipe must not be used after it was reclaimed.
+//
+// The pipe must have been closed. A pipe is only reclaimed once it has been
+// fully drained or the reader has closed its half of the pipe. Otherwise,
+// a reader may still be consuming data, so Put leaves the pipe alone for the
+// reader to finish with and reports false. Such a pipe is never reused, but
+// may be passed to Put again once it has been drained.
+func (p *Pool) Put(b *BufferPipe) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch {
+	case b.pool != p:
+		panic("bufpipe: BufferPipe does not belong to Pool")
+	case atomic.LoadInt32(&b.freed) != 0:
+		panic("bufpipe: BufferPipe released to Pool multiple times")
+	case !b.closed:
+		panic("bufpipe: BufferPipe released to Pool before being closed")
+	}
+	if b.rdPtr != b.cmPtr && !b.rdDone {
+		return false // A reader may still be consuming data
+	}
+	atomic.StoreInt32(&b.freed, 1)
+	b.notify = nil
+
+	if p.debug {
+		nb := NewBufferPipe(b.buf, b.mode)
+		nb.pool = p
+		b.buf = nil
+		p.pool.Put(nb)
+		return true
+	}
+	p.pool.Put(b) // Remains closed until reset by Get
+	return true
+}
+
+// Panics if the pipe has been released to a pool.
+func (b *BufferPipe) checkFreed() {
+	if atomic.LoadInt32(&b.freed) != 0 {
+		panic("bufpipe: use of BufferPipe after release to Pool")
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2014, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package bufpipe
+
+import "io"
+import "sync/atomic"
+
+// This file implements the SPSC mode of operation. Since there is only ever a
+// single producer and a single consumer, the writer is the sole owner of wrPtr
+// and cmPtr, while the reader is the sole owner of rdPtr. Each side atomically
+// publishes updates to its own pointers and atomically observes the pointers
+// owned by the other side.
+//
+// The mutex and condition variables are only used when a routine must block.
+// A blocked routine sets its wait flag while holding the mutex before checking
+// the pointers one last time. The other routine updates its pointer before
+// checking the wait flag, and signals while holding the mutex. Since atomic
+// operations are sequentially consistent, either the waiter observes the new
+// pointer or the other routine observes the wait flag, preventing lost wakeups.
+
+// The amount of available buffer for writing.
+func (b *BufferPipe) writeAvail() int {
+	return b.writeAvailDone(atomic.LoadInt32(&b.done))
+}
+
+// The amount of available buffer for writing given the value of the done flag.
+func (b *BufferPipe) writeAvailDone(done int32) int {
+	if done != 0 {
+		return 0 // Closed buffer is never available
+	}
+	var rdPtr int64 // Amount read has no effect on amount available for Line
+	if b.mode&Ring > 0 {
+		rdPtr = atomic.LoadInt64(&b.rdPtr)
+	}
+	return len(b.buf) - int(atomic.LoadInt64(&b.wrPtr)-rdPtr)
+}
+
+// The amount of valid data for reading.
+func (b *BufferPipe) readValid() int {
+	return b.readValidDone(atomic.LoadInt32(&b.done))
+}
+
+// The amount of valid data for reading given the value of the done flag.
+func (b *BufferPipe) readValidDone(done int32) int {
+	switch {
+	case done == 0 && b.mode&Dual == 0:
+		return 0 // Mono mode hides all data until closed
+	case done == 2:
+		return 0 // Closed read half never has valid data
+	}
+	return int(atomic.LoadInt64(&b.cmPtr) - atomic.LoadInt64(&b.rdPtr))
+}
+
+func (b *BufferPipe) writeWaitSPSC() int {
+	availCnt := b.writeAvail()
+	if availCnt > 0 || b.mode&BlockI == 0 {
+		return availCnt
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	atomic.StoreInt32(&b.wrWait, 1)
+	for availCnt = b.writeAvail(); !b.closed && availCnt == 0 && !b.stagedFull(); availCnt = b.writeAvail() {
+		b.wait(&b.wrCond, &b.wrIdle)
+	}
+	atomic.StoreInt32(&b.wrWait, 0)
+	return availCnt
+}
+
+func (b *BufferPipe) readWaitSPSC() int {
+	validCnt := b.readValid()
+	if validCnt > 0 || b.mode&BlockO == 0 {
+		return validCnt
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	atomic.StoreInt32(&b.rdWait, 1)
+	for validCnt = b.readValid(); !b.closed && validCnt == 0; validCnt = b.readValid() {
+		b.wait(&b.rdCond, &b.rdIdle)
+	}
+	atomic.StoreInt32(&b.rdWait, 0)
+	return validCnt
+}
+
+func (b *BufferPipe) writeSlicesSPSC() (bufLo, bufHi []byte, err error) {
+	availCnt := b.writeWaitSPSC() // Block until there is available buffer
+	bufLo, bufHi = b.slices(atomic.LoadInt64(&b.wrPtr), availCnt)
+	if len(bufLo) == 0 {
+		b.mutex.Lock()
+		err = b.writeErr()
+		b.mutex.Unlock()
+	}
+	return
+}
+
+// The data is discarded if the pipe was closed since the slices were obtained.
+func (b *BufferPipe) writeMarkSPSC(cnt int) error {
+	done := atomic.LoadInt32(&b.done)
+	if cnt > 0 && done != 0 {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return b.writeErr()
+	}
+	if cnt < 0 || cnt > b.writeAvailDone(done) {
+		panic("invalid mark increment value")
+	}
+	wrPtr := atomic.AddInt64(&b.wrPtr, int64(cnt))
+	atomic.AddInt64(&b.wrCnt, int64(cnt))
+	if b.mode&Staged > 0 {
+		return nil // Readers are only notified upon Commit
+	}
+	atomic.StoreInt64(&b.cmPtr, wrPtr)
+
+	if b.notify != nil || atomic.LoadInt32(&b.rdWait) != 0 {
+		b.mutex.Lock()
+		b.checkWatermarks()
+		b.rdCond.Signal()
+		b.mutex.Unlock()
+	}
+	return nil
+}
+
+func (b *BufferPipe) writeSPSC(data []byte) (cnt int, err error) {
+	for cnt < len(data) {
+		buf, _, err := b.writeSlicesSPSC()
+		if err != nil {
+			return cnt, err
+		}
+
+		copyCnt := copy(buf, data[cnt:])
+		if err := b.writeMarkSPSC(copyCnt); err != nil {
+			return cnt, err
+		}
+		cnt += copyCnt
+	}
+	return cnt, nil
+}
+
+func (b *BufferPipe) readFromSPSC(rd io.Reader) (cnt int64, err error) {
+	for {
+		buf, _, wrErr := b.writeSlicesSPSC()
+		rdCnt, rdErr := rd.Read(buf)
+		if err := b.writeMarkSPSC(rdCnt); err != nil {
+			return cnt, err
+		}
+		cnt += int64(rdCnt)
+
+		switch {
+		case wrErr != nil:
+			return cnt, wrErr
+		case rdErr == io.EOF:
+			return cnt, nil
+		case rdErr != nil:
+			return cnt, rdErr
+		}
+	}
+}
+
+func (b *BufferPipe) readSlicesSPSC() (bufLo, bufHi []byte, err error) {
+	validCnt := b.readWaitSPSC() // Block until there is valid buffer
+	bufLo, bufHi = b.slices(atomic.LoadInt64(&b.rdPtr), validCnt)
+	if len(bufLo) == 0 {
+		b.mutex.Lock()
+		err = b.readErr()
+		b.mutex.Unlock()
+	}
+	return
+}
+
+// The data is not consumed if the read half was closed since the slices were
+// obtained.
+func (b *BufferPipe) readMarkSPSC(cnt int) error {
+	done := atomic.LoadInt32(&b.done)
+	if cnt > 0 && done == 2 {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return b.readErr()
+	}
+	if cnt < 0 || cnt > b.readValidDone(done) {
+		panic("invalid mark increment value")
+	}
+	atomic.AddInt64(&b.rdPtr, int64(cnt))
+	atomic.AddInt64(&b.rdCnt, int64(cnt))
+
+	if b.notify != nil || atomic.LoadInt32(&b.wrWait) != 0 {
+		b.mutex.Lock()
+		b.checkWatermarks()
+		b.wrCond.Signal()
+		b.mutex.Unlock()
+	}
+	return nil
+}
+
+func (b *BufferPipe) readSPSC(data []byte) (cnt int, err error) {
+	for cnt < len(data) {
+		buf, _, err := b.readSlicesSPSC()
+		if err != nil {
+			return cnt, err
+		}
+
+		copyCnt := copy(data[cnt:], buf)
+		if err := b.readMarkSPSC(copyCnt); err != nil {
+			return cnt, err
+		}
+		cnt += copyCnt
+	}
+	return cnt, nil
+}
+
+func (b *BufferPipe) writeToSPSC(wr io.Writer) (cnt int64, err error) {
+	for {
+		data, _, rdErr := b.readSlicesSPSC()
+		wrCnt, wrErr := wr.Write(data)
+		if err := b.readMarkSPSC(wrCnt); err != nil {
+			return cnt, err
+		}
+		cnt += int64(wrCnt)
+
+		switch {
+		case wrErr != nil:
+			return cnt, wrErr
+		case rdErr == io.EOF:
+			return cnt, nil
+		case rdErr != nil:
+			return cnt, rdErr
+		}
+	}
+}
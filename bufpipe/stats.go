@@ -0,0 +1,88 @@
+// Copyright 2014, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package bufpipe
+
+import "sync"
+import "time"
+import "sync/atomic"
+
+// Stats contains statistics about the usage of a BufferPipe.
+type Stats struct {
+	BytesWritten int64 // Total number of bytes marked as written
+	BytesRead    int64 // Total number of bytes marked as read
+
+	// The total amount of time that writers spent blocked waiting for
+	// available buffer, and that readers spent blocked waiting for valid data.
+	WriteWait time.Duration
+	ReadWait  time.Duration
+}
+
+// Statistics about the usage of the pipe since creation or the last Reset.
+//
+// The number of bytes written includes data that was later rolled back.
+// The statistics may be obtained concurrently with other operations.
+func (b *BufferPipe) Stats() Stats {
+	b.checkFreed()
+	return Stats{
+		BytesWritten: atomic.LoadInt64(&b.wrCnt),
+		BytesRead:    atomic.LoadInt64(&b.rdCnt),
+		WriteWait:    time.Duration(atomic.LoadInt64(&b.wrIdle)),
+		ReadWait:     time.Duration(atomic.LoadInt64(&b.rdIdle)),
+	}
+}
+
+// Registers a callback to be notified of pipe pressure.
+//
+// When the Length of the pipe rises to at least high, notify is called with
+// true to indicate a state of high pressure. Afterwards, once the Length falls
+// to at most low, notify is called with false to indicate that the pressure
+// has been relieved. The low and high watermarks must satisfy the condition:
+// 0 <= low < high <= Capacity. A nil notify disables the notifications.
+//
+// The callback is called synchronously by the routine that caused the Length
+// to cross a watermark while an internal lock is held. Thus, it must return
+// quickly and must not call any methods on the pipe.
+//
+// This must be called before the pipe is used.
+func (b *BufferPipe) SetWatermarks(low, high int, notify func(high bool)) {
+	b.checkFreed()
+	if notify != nil && (low < 0 || low >= high || high > len(b.buf)) {
+		panic("invalid watermark values")
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.lowMark, b.highMark = low, high
+	b.notify, b.aboveHigh = notify, false
+}
+
+// Notifies the watermark callback if the valid length has crossed a watermark.
+// The mutex must be held.
+func (b *BufferPipe) checkWatermarks() {
+	if b.notify == nil {
+		return
+	}
+	validCnt := int(atomic.LoadInt64(&b.cmPtr) - atomic.LoadInt64(&b.rdPtr))
+	switch {
+	case !b.aboveHigh && validCnt >= b.highMark:
+		b.aboveHigh = true
+		b.notify(true)
+	case b.aboveHigh && validCnt <= b.lowMark:
+		b.aboveHigh = false
+		b.notify(false)
+	}
+}
+
+// testHookWait, if non-nil, is called right before a routine blocks waiting.
+var testHookWait func()
+
+// Waits on the condition and adds the time spent blocked to the total.
+func (b *BufferPipe) wait(cond *sync.Cond, total *int64) {
+	if testHookWait != nil {
+		testHookWait()
+	}
+	start := time.Now()
+	cond.Wait()
+	atomic.AddInt64(total, int64(time.Since(start)))
+}
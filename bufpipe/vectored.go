@@ -0,0 +1,137 @@
+// Copyright 2014, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package bufpipe
+
+import "io"
+import "net"
+import "errors"
+import "syscall"
+
+var errNoVectoredIO = errors.New("bufpipe: vectored I/O is not supported on this platform")
+
+// Continually read from the connection and write the data to the pipe.
+//
+// Each read fills both slices obtained from WriteSlices using a single
+// vectored read (i.e., readv) system call, such that a ring buffer that wraps
+// around does not require two system calls. Unlike ReadFrom, no lock is held
+// while blocked on the connection. If the pipe is closed in the meantime,
+// then the data read is discarded and the closed pipe error is returned.
+//
+// The connection is typically an *os.File or a net.Conn such as *net.TCPConn.
+// On platforms without vectored I/O support, this falls back to ReadFrom if
+// the connection is an io.Reader.
+func (b *BufferPipe) ReadFromConn(c syscall.Conn) (cnt int64, err error) {
+	b.checkFreed()
+	if !hasVectoredIO {
+		if rd, ok := c.(io.Reader); ok {
+			return b.ReadFrom(rd)
+		}
+		return 0, errNoVectoredIO
+	}
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	return b.readFromConn(rc)
+}
+
+func (b *BufferPipe) readFromConn(rc syscall.RawConn) (cnt int64, err error) {
+	var iovs iovecs
+	for {
+		bufLo, bufHi, wrErr := b.WriteSlices()
+		if wrErr != nil {
+			return cnt, wrErr
+		}
+		rdCnt, rdErr := iovs.readv(rc, bufLo, bufHi)
+		if err := b.writeMarkErr(rdCnt); err != nil {
+			return cnt, err // Pipe was closed while blocked in readv
+		}
+		cnt += int64(rdCnt)
+
+		switch {
+		case rdErr == io.EOF:
+			return cnt, nil
+		case rdErr != nil:
+			return cnt, rdErr
+		}
+	}
+}
+
+// Continually read the contents of the pipe and write them to the connection.
+//
+// Each write drains both slices obtained from ReadSlices using a single
+// vectored write (i.e., writev) system call, such that a ring buffer that wraps
+// around does not require two system calls. Unlike WriteTo, no lock is held
+// while blocked on the connection. If the read half of the pipe is closed in
+// the meantime, then io.ErrClosedPipe is returned.
+//
+// The connection is typically an *os.File or a net.Conn such as *net.TCPConn.
+// On platforms without vectored I/O support, this falls back to writing
+// net.Buffers if the connection is an io.Writer, which still uses vectored
+// I/O for some network connections.
+func (b *BufferPipe) WriteToConn(c syscall.Conn) (cnt int64, err error) {
+	b.checkFreed()
+	if !hasVectoredIO {
+		if wr, ok := c.(io.Writer); ok {
+			return b.writeToBuffers(wr)
+		}
+		return 0, errNoVectoredIO
+	}
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	return b.writeToConn(rc)
+}
+
+func (b *BufferPipe) writeToConn(rc syscall.RawConn) (cnt int64, err error) {
+	var iovs iovecs
+	for {
+		bufLo, bufHi, rdErr := b.ReadSlices()
+		if rdErr == io.EOF {
+			return cnt, nil
+		} else if rdErr != nil {
+			return cnt, rdErr
+		}
+		wrCnt, wrErr := iovs.writev(rc, bufLo, bufHi)
+		if err := b.readMarkErr(wrCnt); err != nil {
+			return cnt, err // Read half was closed while blocked in writev
+		}
+		cnt += int64(wrCnt)
+		if wrErr != nil {
+			return cnt, wrErr
+		}
+	}
+}
+
+func (b *BufferPipe) writeToBuffers(wr io.Writer) (cnt int64, err error) {
+	for {
+		bufLo, bufHi, rdErr := b.ReadSlices()
+		if rdErr == io.EOF {
+			return cnt, nil
+		} else if rdErr != nil {
+			return cnt, rdErr
+		}
+		bufs := net.Buffers{bufLo, bufHi}
+		wrCnt, wrErr := bufs.WriteTo(wr)
+		if err := b.readMarkErr(int(wrCnt)); err != nil {
+			return cnt, err
+		}
+		cnt += wrCnt
+		if wrErr != nil {
+			return cnt, wrErr
+		}
+	}
+}
+
+// Returns the raw connection for v if vectored I/O may be used with it.
+func rawConn(v interface{}) syscall.RawConn {
+	if c, ok := v.(syscall.Conn); ok && hasVectoredIO {
+		if rc, err := c.SyscallConn(); err == nil {
+			return rc
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2014, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package bufpipe
+
+import "io"
+import "os"
+import "unsafe"
+import "syscall"
+
+const hasVectoredIO = true
+
+// iovecs is a reusable array of I/O vectors for two slices.
+type iovecs struct {
+	vecs [2]syscall.Iovec
+}
+
+func (iovs *iovecs) load(bufLo, bufHi []byte) []syscall.Iovec {
+	vecs := iovs.vecs[:0]
+	for _, buf := range [][]byte{bufLo, bufHi} {
+		if len(buf) > 0 {
+			vecs = append(vecs, syscall.Iovec{Base: &buf[0]})
+			vecs[len(vecs)-1].SetLen(len(buf))
+		}
+	}
+	return vecs
+}
+
+func (iovs *iovecs) readv(rc syscall.RawConn, bufLo, bufHi []byte) (int, error) {
+	vecs := iovs.load(bufLo, bufHi)
+	if len(vecs) == 0 {
+		return 0, nil
+	}
+	cnt, err := iovs.do(rc.Read, syscall.SYS_READV, "readv", vecs)
+	if err != nil {
+		return 0, err
+	}
+	if cnt == 0 {
+		return 0, io.EOF
+	}
+	return cnt, nil
+}
+
+func (iovs *iovecs) writev(rc syscall.RawConn, bufLo, bufHi []byte) (int, error) {
+	vecs := iovs.load(bufLo, bufHi)
+	if len(vecs) == 0 {
+		return 0, nil
+	}
+	return iovs.do(rc.Write, syscall.SYS_WRITEV, "writev", vecs)
+}
+
+// Performs the vectored I/O system call, waiting for the file descriptor to be
+// ready if the call would otherwise block.
+func (iovs *iovecs) do(wait func(func(uintptr) bool) error, trap uintptr, name string, vecs []syscall.Iovec) (int, error) {
+	var cnt uintptr
+	var errno syscall.Errno
+	err := wait(func(fd uintptr) bool {
+		for {
+			cnt, _, errno = syscall.Syscall(trap, fd, uintptr(unsafe.Pointer(&vecs[0])), uintptr(len(vecs)))
+			if errno != syscall.EINTR {
+				return errno != syscall.EAGAIN
+			}
+		}
+	})
+	switch {
+	case err != nil:
+		return 0, err
+	case errno != 0:
+		return 0, os.NewSyscallError(name, errno)
+	default:
+		return int(cnt), nil
+	}
+}
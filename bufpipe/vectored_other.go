@@ -0,0 +1,22 @@
+// Copyright 2014, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+//go:build !linux
+// +build !linux
+
+package bufpipe
+
+import "syscall"
+
+const hasVectoredIO = false
+
+type iovecs struct{}
+
+func (*iovecs) readv(rc syscall.RawConn, bufLo, bufHi []byte) (int, error) {
+	return 0, errNoVectoredIO
+}
+
+func (*iovecs) writev(rc syscall.RawConn, bufLo, bufHi []byte) (int, error) {
+	return 0, errNoVectoredIO
+}
@@ -0,0 +1,31 @@
+// Copyright 2014, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package bufpipe
+
+// NewVirtualRingBufferPipe creates a BufferPipe with an internal buffer of at
+// least size bytes, where the buffer is mapped twice back-to-back in virtual
+// memory. Accesses past the end of the buffer transparently wrap around to the
+// front, such that in Ring mode, WriteSlices and ReadSlices always return all
+// available space or valid data in the first slice, and the second slice is
+// always empty.
+//
+// Virtual rings require that the size be a multiple of the page size.
+// Thus, the Capacity of the returned pipe may be larger than size.
+//
+// If virtual rings are not supported by the platform, then this falls back to
+// a regular heap-allocated buffer, where the second slice may be non-empty.
+//
+// Call Unmap to release the virtual ring once the pipe is no longer in use.
+func NewVirtualRingBufferPipe(size int, mode int) *BufferPipe {
+	if size > 0 {
+		if vbuf, unmap, err := mmapVirtualRing(size); err == nil {
+			b := NewBufferPipe(vbuf[:len(vbuf)/2], mode)
+			b.vbuf = vbuf[:len(vbuf):len(vbuf)]
+			b.unmap = unmap
+			return b
+		}
+	}
+	return NewBufferPipe(make([]byte, size), mode)
+}
@@ -0,0 +1,58 @@
+// Copyright 2014, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+//go:build amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64
+// +build amd64 arm64 loong64 mips64 mips64le ppc64 ppc64le riscv64
+
+package bufpipe
+
+import "os"
+import "unsafe"
+import "syscall"
+import "io/ioutil"
+
+// mmapVirtualRing maps a temporary file of size bytes (rounded up to the page
+// size) twice into a contiguous region of virtual memory. It returns the
+// entire doubly mapped region, which is twice the length of the ring.
+func mmapVirtualRing(size int) (vbuf []byte, unmap func() error, err error) {
+	pageSize := os.Getpagesize()
+	size = (size + pageSize - 1) / pageSize * pageSize
+
+	// Back the ring with an unlinked temporary file, preferring shared memory.
+	f, err := ioutil.TempFile("/dev/shm", "bufpipe")
+	if err != nil {
+		if f, err = ioutil.TempFile("", "bufpipe"); err != nil {
+			return nil, nil, err
+		}
+	}
+	defer f.Close() // The mappings keep the memory alive
+	if err := os.Remove(f.Name()); err != nil {
+		return nil, nil, err
+	}
+	if err := f.Truncate(int64(size)); err != nil {
+		return nil, nil, err
+	}
+
+	// Reserve a region of address space for both halves, and then replace
+	// each half with a shared mapping of the same file.
+	const anon = syscall.MAP_PRIVATE | syscall.MAP_ANONYMOUS
+	vbuf, err = syscall.Mmap(-1, 0, 2*size, syscall.PROT_NONE, anon)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("mmap", err)
+	}
+	for _, off := range []int{0, size} {
+		const prot = syscall.PROT_READ | syscall.PROT_WRITE
+		const flags = syscall.MAP_SHARED | syscall.MAP_FIXED
+		_, _, errno := syscall.Syscall6(syscall.SYS_MMAP,
+			uintptr(unsafe.Pointer(&vbuf[off])), uintptr(size),
+			prot, flags, f.Fd(), 0)
+		if errno != 0 {
+			syscall.Munmap(vbuf)
+			return nil, nil, os.NewSyscallError("mmap", errno)
+		}
+	}
+	return vbuf, func() error {
+		return os.NewSyscallError("munmap", syscall.Munmap(vbuf))
+	}, nil
+}
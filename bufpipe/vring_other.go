@@ -0,0 +1,12 @@
+// Copyright 2014, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+//go:build !linux || !(amd64 || arm64 || loong64 || mips64 || mips64le || ppc64 || ppc64le || riscv64)
+// +build !linux !amd64,!arm64,!loong64,!mips64,!mips64le,!ppc64,!ppc64le,!riscv64
+
+package bufpipe
+
+func mmapVirtualRing(size int) (vbuf []byte, unmap func() error, err error) {
+	return nil, nil, errNoMmap
+}
@@ -0,0 +1,158 @@
+// Copyright 2017, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package memfile
+
+import "unsafe"
+
+// DefaultChunkSize is the chunk size used when a non-sparse File is converted
+// to chunked storage by Clone or Snapshot.
+const DefaultChunkSize = 64 << 10
+
+// Range is a contiguous range of bytes within a File.
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+// Clone returns a new independent File with the same contents as fb,
+// where the contents are shared with copy-on-write at chunk granularity.
+// Subsequent writes to either File only copy the chunks being modified.
+// The cost of Clone is proportional to the number of chunks, not their size.
+//
+// The clone of a non-sparse File uses chunked storage with DefaultChunkSize,
+// while fb itself remains non-sparse and copies its contents upon
+// the next write.
+func (fb *File) Clone() *File {
+	r := fb.base()
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	src := r
+	if r.chunkSize == 0 {
+		// Chunk the contents once and share them among all clones until
+		// the contents of fb change, which copies them first.
+		if r.chunked == nil {
+			r.chunked = new(File)
+			r.chunked.toChunks(r.b)
+			r.shared = true
+		}
+		src = r.chunked
+	}
+	c := &File{
+		mode:      r.mode,
+		modeSet:   r.modeSet,
+		modTime:   r.modTime,
+		chunkSize: src.chunkSize,
+		chunks:    make(map[int64][]byte, len(src.chunks)),
+		owned:     make(map[int64]bool),
+		n:         src.n,
+		name:      fb.name,
+	}
+	for idx, ch := range src.chunks {
+		c.chunks[idx] = ch
+	}
+	if src == r {
+		r.owned = make(map[int64]bool) // All chunks are now shared
+		r.pinned = nil
+	}
+	return c
+}
+
+// Snapshot returns a read-only Clone of fb, which captures the contents of fb
+// at the time of the call. Handles opened on the snapshot are also read-only,
+// such that opening it for writing reports an error wrapping fs.ErrPermission.
+func (fb *File) Snapshot() *File {
+	c := fb.Clone()
+	c.readOnly = true
+	return &File{root: c, name: c.name, noWrite: true}
+}
+
+// toChunks initializes an empty File with chunked storage holding b,
+// where whole chunks alias b and the partial last chunk is a copy.
+func (fb *File) toChunks(b []byte) {
+	cs := DefaultChunkSize
+	fb.chunkSize = cs
+	fb.chunks = make(map[int64][]byte)
+	fb.owned = make(map[int64]bool)
+	fb.n = int64(len(b))
+	for idx := int64(0); len(b) > 0; idx++ {
+		if len(b) >= cs {
+			fb.chunks[idx] = b[:cs:cs] // Not owned since b is aliased
+			b = b[cs:]
+		} else {
+			c := make([]byte, cs)
+			copy(c, b)
+			fb.chunks[idx] = c
+			fb.owned[idx] = true
+			b = nil
+		}
+	}
+}
+
+// Diff reports the ranges of bytes that differ between x and y,
+// in order of increasing offset. Bytes past the end of the shorter file
+// are always reported as different.
+//
+// Chunks shared between Files from the same Clone or Snapshot lineage
+// are skipped without being compared.
+func Diff(x, y *File) []Range {
+	xs, ys := x.base(), y.base()
+
+	// Lock in a consistent order to avoid deadlocking with Diff(y, x).
+	m1, m2 := &xs.m, &ys.m
+	if uintptr(unsafe.Pointer(m1)) > uintptr(unsafe.Pointer(m2)) {
+		m1, m2 = m2, m1
+	}
+	m1.RLock()
+	defer m1.RUnlock()
+	if m2 != m1 {
+		m2.RLock()
+		defer m2.RUnlock()
+	}
+
+	var rs []Range
+	add := func(off, n int64) {
+		if k := len(rs) - 1; k >= 0 && rs[k].Offset+rs[k].Length == off {
+			rs[k].Length += n
+		} else if n > 0 {
+			rs = append(rs, Range{off, n})
+		}
+	}
+
+	size := min64(xs.size(), ys.size())
+	cs := int64(xs.chunkSize)
+	if cs == 0 {
+		cs = int64(ys.chunkSize)
+	}
+	if cs == 0 {
+		cs = DefaultChunkSize
+	}
+	sameChunks := xs.chunkSize > 0 && xs.chunkSize == ys.chunkSize
+	bx, by := make([]byte, cs), make([]byte, cs)
+	for off := int64(0); off < size; off += cs {
+		n := min64(cs, size-off)
+		if sameChunks {
+			cx, cy := xs.chunks[off/cs], ys.chunks[off/cs]
+			if (cx == nil && cy == nil) || (cx != nil && cy != nil && &cx[0] == &cy[0]) {
+				continue // Identical holes or shared chunks
+			}
+		}
+		xs.readAt(bx[:n], off)
+		ys.readAt(by[:n], off)
+		for i := int64(0); i < n; {
+			j := i
+			for j < n && bx[j] != by[j] {
+				j++
+			}
+			add(off+i, j-i)
+			for j < n && bx[j] == by[j] {
+				j++
+			}
+			i = j
+		}
+	}
+	add(size, max64(xs.size(), ys.size())-size)
+	return rs
+}
@@ -0,0 +1,146 @@
+// Copyright 2017, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package memfile
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"math/rand"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestClone(t *testing.T) {
+	rnd := rand.New(rand.NewSource(0))
+	image := make([]byte, 1<<20+1)
+	rnd.Read(image)
+	orig := New(append([]byte(nil), image...))
+
+	// Cloning does not copy the contents.
+	var clones []*File
+	for i := 0; i < 1000; i++ {
+		clones = append(clones, orig.Clone())
+	}
+	for i, c := range clones {
+		if got := c.Footprint(); got != 0 {
+			t.Fatalf("clone %d, Footprint() = %d, want 0", i, got)
+		}
+	}
+
+	// Cloning leaves a non-sparse File non-sparse, such that Bytes
+	// still returns the contents without a copy.
+	flat := New([]byte("hello, world"))
+	live := flat.Bytes()
+	flatClone := flat.Clone()
+	if got := flat.Bytes(); flat.chunkSize != 0 || &got[0] != &live[0] {
+		t.Errorf("Clone converted the non-sparse source to chunked storage")
+	}
+	flat.WriteAt([]byte("J"), 0)
+	flatClone.WriteAt([]byte("W"), 7)
+	if got, want := string(flat.Bytes()), "Jello, world"; got != want {
+		t.Errorf("source Bytes() = %q, want %q", got, want)
+	}
+	if got, want := string(flatClone.Bytes()), "hello, World"; got != want {
+		t.Errorf("clone Bytes() = %q, want %q", got, want)
+	}
+
+	// Writes only copy the modified chunks.
+	clones[0].WriteAt([]byte("hello"), DefaultChunkSize-2)
+	if got, want := clones[0].Footprint(), int64(2*DefaultChunkSize); got != want {
+		t.Errorf("Footprint() = %d, want %d", got, want)
+	}
+	if !bytes.Equal(orig.Bytes(), image) || !bytes.Equal(clones[1].Bytes(), image) {
+		t.Errorf("write to clone modified other clones")
+	}
+	orig.Truncate(10)
+	if !bytes.Equal(clones[1].Bytes(), image) {
+		t.Errorf("truncate of original modified clones")
+	}
+
+	// Snapshots are read-only and unaffected by later writes.
+	snap := clones[0].Snapshot()
+	clones[0].WriteAt([]byte("world"), 0)
+	if _, err := snap.Write([]byte("x")); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("Write on snapshot error = %v, want %v", err, syscall.EBADF)
+	}
+	if got := snap.Bytes()[DefaultChunkSize-2:][:5]; string(got) != "hello" {
+		t.Errorf("snapshot contents = %q, want %q", got, "hello")
+	}
+	for _, flag := range []int{os.O_WRONLY, os.O_RDWR, os.O_RDONLY | os.O_TRUNC} {
+		if _, err := snap.Open(flag); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("Open(%#x) on snapshot error = %v, want %v", flag, err, fs.ErrPermission)
+		}
+	}
+	if h, err := snap.Open(os.O_RDONLY); err != nil {
+		t.Errorf("Open(O_RDONLY) on snapshot error = %v", err)
+	} else if _, err := h.Write([]byte("x")); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("Write on snapshot handle error = %v, want %v", err, syscall.EBADF)
+	}
+
+	// Diff only reports the modified ranges.
+	sparse := NewSparse(3)
+	sparse.WriteAt([]byte("abcdef"), 0)
+	for _, tt := range []struct {
+		x, y *File
+		want []Range
+	}{
+		{clones[1], clones[2], nil},
+		{clones[1], snap, []Range{{DefaultChunkSize - 2, 5}}},
+		{clones[1], clones[0], []Range{{0, 5}, {DefaultChunkSize - 2, 5}}},
+		{orig, clones[1], []Range{{10, int64(len(image)) - 10}}},
+		{New([]byte("abcdef")), New([]byte("aBCdEfg")), []Range{{1, 2}, {4, 1}, {6, 1}}},
+		{sparse, New([]byte("abXdef")), []Range{{2, 1}}},
+	} {
+		if got := Diff(tt.x, tt.y); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Diff() = %v, want %v", got, tt.want)
+		}
+	}
+
+	// Diff does not modify its inputs.
+	x, y := New([]byte("abc")), New([]byte("abd"))
+	Diff(x, y)
+	Diff(x, x)
+	if x.chunkSize != 0 || y.chunkSize != 0 {
+		t.Errorf("Diff converted its inputs to chunked storage")
+	}
+	if got, want := clones[0].Footprint(), int64(DefaultChunkSize); got != want {
+		t.Errorf("Footprint() after Diff = %d, want %d", got, want)
+	}
+}
+
+func TestCloneRandom(t *testing.T) {
+	// Randomly modify a family of clones and compare against flat copies.
+	rnd := rand.New(rand.NewSource(0))
+	files := []*File{NewSparse(16)}
+	wants := [][]byte{nil}
+	for i := 0; i < 5000; i++ {
+		k := rnd.Intn(len(files))
+		switch off := rnd.Int63n(200); rnd.Intn(4) {
+		case 0:
+			files = append(files, files[k].Clone())
+			wants = append(wants, append([]byte(nil), wants[k]...))
+		case 1:
+			f := New(append([]byte(nil), wants[k]...))
+			f.Truncate(off)
+			files[k].Truncate(off)
+			wants[k] = f.Bytes()
+		default:
+			b := make([]byte, rnd.Intn(40))
+			rnd.Read(b)
+			f := New(append([]byte(nil), wants[k]...))
+			f.WriteAt(b, off)
+			files[k].WriteAt(b, off)
+			wants[k] = f.Bytes()
+		}
+	}
+	for k := range files {
+		if !bytes.Equal(files[k].Bytes(), wants[k]) {
+			t.Fatalf("file %d, Bytes() mismatch", k)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2017, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package memfile
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+)
+
+// DefaultSectorSize is the sector size used by a CrashFile if unspecified.
+const DefaultSectorSize = 512
+
+// CrashFile wraps a File and models which writes survive a crash.
+//
+// Reads observe all writes as usual. However, only data that was written
+// before the last call to Sync is durable. Each write since then is split into
+// pieces at sector boundaries, where each piece may independently be lost upon
+// a crash. Thus, unsynced writes may be lost entirely or torn at sector
+// granularity, and a later write may survive while an earlier one is lost.
+// The pieces that survive are always applied in the order they were written,
+// so where an earlier and a later write overlap, the later one never appears
+// to be overwritten by the earlier one.
+// Truncations since the last Sync may similarly be lost.
+//
+// Only the Write, WriteAt, WriteString, ReadFrom, Truncate, and Sync methods
+// of a CrashFile are tracked; other handles to the underlying File are not.
+type CrashFile struct {
+	*File
+
+	m          sync.Mutex
+	sectorSize int64
+	synced     []byte       // durable contents as of the last Sync
+	pending    []crashPiece // unsynced writes in the order performed
+}
+
+// crashPiece is a write that is atomic with respect to a crash.
+type crashPiece struct {
+	off      int64
+	data     []byte
+	truncate bool // truncate to off instead of writing data
+}
+
+// NewCrashFile creates a new CrashFile with b as its durable initial contents.
+// If sectorSize is not positive, DefaultSectorSize is used.
+// The new CrashFile takes ownership of b.
+func NewCrashFile(b []byte, sectorSize int) *CrashFile {
+	if sectorSize <= 0 {
+		sectorSize = DefaultSectorSize
+	}
+	return &CrashFile{
+		File:       New(b),
+		sectorSize: int64(sectorSize),
+		synced:     append([]byte(nil), b...),
+	}
+}
+
+// record splits the write of b at off into sector-sized pieces.
+// The lock must be held.
+func (cf *CrashFile) record(b []byte, off int64) {
+	for len(b) > 0 {
+		n := int(cf.sectorSize - off%cf.sectorSize)
+		if n > len(b) {
+			n = len(b)
+		}
+		cf.pending = append(cf.pending, crashPiece{off: off, data: append([]byte(nil), b[:n]...)})
+		b, off = b[n:], off+int64(n)
+	}
+}
+
+// Write writes to the File and records the write as unsynced.
+func (cf *CrashFile) Write(b []byte) (int, error) {
+	cf.m.Lock()
+	defer cf.m.Unlock()
+	off, n, err := cf.File.write(b, nil)
+	cf.record(b[:n], off)
+	return n, err
+}
+
+// WriteAt writes to the File and records the write as unsynced.
+func (cf *CrashFile) WriteAt(b []byte, off int64) (int, error) {
+	cf.m.Lock()
+	defer cf.m.Unlock()
+	n, err := cf.File.WriteAt(b, off)
+	cf.record(b[:n], off)
+	return n, err
+}
+
+// WriteString writes s to the File and records the write as unsynced.
+func (cf *CrashFile) WriteString(s string) (int, error) {
+	return writeString(cf, s)
+}
+
+// ReadFrom copies r to the File and records the writes as unsynced.
+func (cf *CrashFile) ReadFrom(r io.Reader) (int64, error) {
+	return readFrom(cf, r)
+}
+
+// Truncate truncates the File and records the truncation as unsynced.
+func (cf *CrashFile) Truncate(n int64) error {
+	cf.m.Lock()
+	defer cf.m.Unlock()
+	if err := cf.File.Truncate(n); err != nil {
+		return err
+	}
+	cf.pending = append(cf.pending, crashPiece{off: n, truncate: true})
+	return nil
+}
+
+// Sync makes all previous writes durable.
+func (cf *CrashFile) Sync() error {
+	cf.m.Lock()
+	defer cf.m.Unlock()
+	if err := cf.File.Sync(); err != nil {
+		return err
+	}
+	cf.synced = append(cf.synced[:0], cf.File.Bytes()...)
+	cf.pending = nil
+	return nil
+}
+
+// Synced returns a copy of the contents as of the last Sync.
+func (cf *CrashFile) Synced() []byte {
+	cf.m.Lock()
+	defer cf.m.Unlock()
+	return append([]byte(nil), cf.synced...)
+}
+
+// Images returns all distinct contents that the file may have after a crash.
+// The set of images always includes the synced contents and, by extension,
+// the current contents.
+//
+// The number of images may grow exponentially with the number of pieces
+// written since the last Sync. Use RandomImage to sample outcomes instead.
+func (cf *CrashFile) Images() [][]byte {
+	cf.m.Lock()
+	defer cf.m.Unlock()
+
+	images := map[string]bool{string(cf.synced): true}
+	for _, p := range cf.pending {
+		next := make(map[string]bool, 2*len(images))
+		for s := range images {
+			next[s] = true
+			next[string(p.apply([]byte(s)))] = true
+		}
+		images = next
+	}
+
+	var bs [][]byte
+	for s := range images {
+		bs = append(bs, []byte(s))
+	}
+	return bs
+}
+
+// RandomImage returns one possible contents of the file after a crash,
+// where each unsynced piece is independently kept with probability 1/2.
+func (cf *CrashFile) RandomImage(r *rand.Rand) []byte {
+	cf.m.Lock()
+	defer cf.m.Unlock()
+	b := append([]byte(nil), cf.synced...)
+	for _, p := range cf.pending {
+		if r.Intn(2) == 0 {
+			b = p.apply(b)
+		}
+	}
+	return b
+}
+
+// apply applies the piece to b, which it may modify in place.
+func (p crashPiece) apply(b []byte) []byte {
+	if p.truncate {
+		if p.off <= int64(len(b)) {
+			return b[:p.off]
+		}
+		return append(b, make([]byte, p.off-int64(len(b)))...)
+	}
+	if end := p.off + int64(len(p.data)); end > int64(len(b)) {
+		b = append(b, make([]byte, end-int64(len(b)))...)
+	}
+	copy(b[p.off:], p.data)
+	return b
+}
@@ -0,0 +1,82 @@
+// Copyright 2017, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package memfile
+
+import (
+	"io"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestCrashFile(t *testing.T) {
+	images := func(cf *CrashFile) []string {
+		var ss []string
+		for _, b := range cf.Images() {
+			ss = append(ss, string(b))
+		}
+		sort.Strings(ss)
+		return ss
+	}
+	equal := func(x, y []string) bool {
+		if len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if x[i] != y[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	cf := NewCrashFile([]byte("0000"), 2)
+	if got, want := images(cf), []string{"0000"}; !equal(got, want) {
+		t.Errorf("Images() = %q, want %q", got, want)
+	}
+
+	// A write spanning two sectors may be torn.
+	cf.WriteAt([]byte("ab"), 1)
+	if got, want := images(cf), []string{"0000", "00b0", "0a00", "0ab0"}; !equal(got, want) {
+		t.Errorf("Images() = %q, want %q", got, want)
+	}
+	cf.Sync()
+	if got, want := images(cf), []string{"0ab0"}; !equal(got, want) {
+		t.Errorf("Images() = %q, want %q", got, want)
+	}
+
+	// Appends and truncations may be lost or reordered.
+	cf.Seek(0, io.SeekEnd)
+	cf.Write([]byte("cd"))
+	cf.Truncate(2)
+	if got, want := images(cf), []string{"0a", "0ab0", "0ab0cd"}; !equal(got, want) {
+		t.Errorf("Images() = %q, want %q", got, want)
+	}
+	if got, want := string(cf.Synced()), "0ab0"; got != want {
+		t.Errorf("Synced() = %q, want %q", got, want)
+	}
+	if got, want := string(cf.Bytes()), "0a"; got != want {
+		t.Errorf("Bytes() = %q, want %q", got, want)
+	}
+
+	// Every random image must be one of the possible images.
+	cf.WriteAt([]byte("wxyz"), 3)
+	all := make(map[string]bool)
+	for _, s := range images(cf) {
+		all[s] = true
+	}
+	rnd := rand.New(rand.NewSource(0))
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		s := string(cf.RandomImage(rnd))
+		if !all[s] {
+			t.Fatalf("RandomImage() = %q, not in Images()", s)
+		}
+		seen[s] = true
+	}
+	if len(seen) != len(all) {
+		t.Errorf("RandomImage() produced %d distinct images, want %d", len(seen), len(all))
+	}
+}
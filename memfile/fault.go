@@ -0,0 +1,217 @@
+// Copyright 2017, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package memfile
+
+import (
+	"io"
+	"io/fs"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FaultFile wraps a File and deterministically injects faults into its
+// Read, ReadAt, Write, WriteAt, Seek, Truncate, and Sync operations,
+// which is useful for testing the error handling of storage code.
+// All other methods are passed through to the underlying File.
+//
+// The configuration fields must not be modified concurrently with I/O.
+type FaultFile struct {
+	*File
+
+	// Err is the error wrapped by an fs.PathError for injected failures.
+	// If nil, syscall.EIO is used.
+	Err error
+
+	// FailAfterBytes, if positive, causes reads and writes to fail once a
+	// total of FailAfterBytes bytes have been transferred by them.
+	// The operation that crosses the limit transfers up to the limit.
+	FailAfterBytes int64
+
+	// FailAfterCalls, if positive, causes all operations to fail once
+	// FailAfterCalls operations have been performed.
+	// If negative, all operations fail.
+	FailAfterCalls int
+
+	// ShortWrite, if positive, limits every write to at most ShortWrite bytes,
+	// where writes of more data report io.ErrShortWrite.
+	ShortWrite int
+
+	// SizeLimit, if positive, is the maximum size of the file, where writes
+	// and truncations beyond the limit report syscall.ENOSPC.
+	// Writes that cross the limit are performed up to the limit.
+	SizeLimit int64
+
+	// Latency is the delay added before every operation.
+	Latency time.Duration
+
+	m     sync.Mutex
+	bytes int64 // total bytes transferred by reads and writes
+	calls int   // total number of operations
+}
+
+// begin accounts for a new operation, reporting an error if it must fail.
+func (ff *FaultFile) begin(op string) error {
+	if ff.Latency > 0 {
+		time.Sleep(ff.Latency)
+	}
+	ff.m.Lock()
+	defer ff.m.Unlock()
+	ff.calls++
+	if ff.FailAfterCalls < 0 || (ff.FailAfterCalls > 0 && ff.calls > ff.FailAfterCalls) {
+		return ff.fault(op)
+	}
+	return nil
+}
+
+func (ff *FaultFile) fault(op string) error {
+	err := ff.Err
+	if err == nil {
+		err = syscall.EIO
+	}
+	return &fs.PathError{Op: op, Path: ff.Name(), Err: err}
+}
+
+// limitBytes reserves the number of bytes among n that may be transferred
+// and returns it along with the error to report if less than n.
+// Reserving up front ensures that concurrent operations never exceed
+// FailAfterBytes in total. Unused bytes must be returned with unreserve.
+func (ff *FaultFile) limitBytes(op string, n int) (int, error) {
+	ff.m.Lock()
+	defer ff.m.Unlock()
+	if ff.FailAfterBytes > 0 {
+		if left := max64(0, ff.FailAfterBytes-ff.bytes); int64(n) > left {
+			ff.bytes += left
+			return int(left), ff.fault(op)
+		}
+	}
+	ff.bytes += int64(n)
+	return n, nil
+}
+
+// unreserve returns the bytes reserved by limitBytes that were not transferred.
+func (ff *FaultFile) unreserve(reserved, n int) {
+	ff.m.Lock()
+	ff.bytes -= int64(reserved - n)
+	ff.m.Unlock()
+}
+
+// limitWrite is like limitBytes, but also applies the ShortWrite
+// and SizeLimit options for a write of n bytes at offset off.
+func (ff *FaultFile) limitWrite(op string, n int, off int64) (int, error) {
+	var err error
+	if ff.SizeLimit > 0 && off+int64(n) > ff.SizeLimit {
+		n = int(max64(0, ff.SizeLimit-off))
+		err = &fs.PathError{Op: op, Path: ff.Name(), Err: syscall.ENOSPC}
+	}
+	if ff.ShortWrite > 0 && n > ff.ShortWrite {
+		n, err = ff.ShortWrite, io.ErrShortWrite
+	}
+	if m, errLimit := ff.limitBytes(op, n); m < n {
+		n, err = m, errLimit
+	}
+	return n, err
+}
+
+// Read reads from the underlying File, subject to injected faults.
+func (ff *FaultFile) Read(b []byte) (int, error) {
+	if err := ff.begin("read"); err != nil {
+		return 0, err
+	}
+	m, errLimit := ff.limitBytes("read", len(b))
+	n, err := ff.File.Read(b[:m])
+	ff.unreserve(m, n)
+	if err == nil && m < len(b) {
+		err = errLimit
+	}
+	return n, err
+}
+
+// ReadAt reads from the underlying File, subject to injected faults.
+func (ff *FaultFile) ReadAt(b []byte, off int64) (int, error) {
+	if err := ff.begin("read"); err != nil {
+		return 0, err
+	}
+	m, errLimit := ff.limitBytes("read", len(b))
+	n, err := ff.File.ReadAt(b[:m], off)
+	ff.unreserve(m, n)
+	if err == nil && m < len(b) {
+		err = errLimit
+	}
+	return n, err
+}
+
+// Write writes to the underlying File, subject to injected faults.
+func (ff *FaultFile) Write(b []byte) (int, error) {
+	if err := ff.begin("write"); err != nil {
+		return 0, err
+	}
+	// The offset must be determined while the File is locked for writing,
+	// otherwise SizeLimit could be applied to a stale offset.
+	var m int
+	_, n, err := ff.File.write(b, func(off int64) (int, error) {
+		var err error
+		m, err = ff.limitWrite("write", len(b), off)
+		return m, err
+	})
+	ff.unreserve(m, n)
+	return n, err
+}
+
+// WriteAt writes to the underlying File, subject to injected faults.
+func (ff *FaultFile) WriteAt(b []byte, off int64) (int, error) {
+	if err := ff.begin("write"); err != nil {
+		return 0, err
+	}
+	m, errLimit := ff.limitWrite("write", len(b), off)
+	n, err := ff.File.WriteAt(b[:m], off)
+	ff.unreserve(m, n)
+	if err == nil && m < len(b) {
+		err = errLimit
+	}
+	return n, err
+}
+
+// WriteString writes s to the underlying File, subject to injected faults.
+func (ff *FaultFile) WriteString(s string) (int, error) {
+	return writeString(ff, s)
+}
+
+// ReadFrom copies r to the underlying File, subject to injected faults.
+func (ff *FaultFile) ReadFrom(r io.Reader) (int64, error) {
+	return readFrom(ff, r)
+}
+
+// WriteTo copies the underlying File to w, subject to injected faults.
+func (ff *FaultFile) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(ff, w)
+}
+
+// Seek seeks the underlying File, subject to injected faults.
+func (ff *FaultFile) Seek(offset int64, whence int) (int64, error) {
+	if err := ff.begin("seek"); err != nil {
+		return 0, err
+	}
+	return ff.File.Seek(offset, whence)
+}
+
+// Truncate truncates the underlying File, subject to injected faults.
+func (ff *FaultFile) Truncate(n int64) error {
+	if err := ff.begin("truncate"); err != nil {
+		return err
+	}
+	if ff.SizeLimit > 0 && n > ff.SizeLimit {
+		return &fs.PathError{Op: "truncate", Path: ff.Name(), Err: syscall.ENOSPC}
+	}
+	return ff.File.Truncate(n)
+}
+
+// Sync syncs the underlying File, subject to injected faults.
+func (ff *FaultFile) Sync() error {
+	if err := ff.begin("sync"); err != nil {
+		return err
+	}
+	return ff.File.Sync()
+}
@@ -0,0 +1,138 @@
+// Copyright 2017, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package memfile
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFaultFile(t *testing.T) {
+	errFault := errors.New("fault")
+	type testOp struct {
+		op       string // read, write, writeat, seek, truncate, or sync
+		data     string // data to write or number of bytes to read
+		off      int64
+		wantCnt  int
+		wantData string
+		wantErr  error
+	}
+	tests := []struct {
+		ff      *FaultFile
+		ops     []testOp
+		wantBuf string
+	}{{
+		ff: &FaultFile{FailAfterBytes: 8, Err: errFault},
+		ops: []testOp{
+			{op: "write", data: "hello", wantCnt: 5},
+			{op: "write", data: "world", wantCnt: 3, wantErr: errFault},
+			{op: "write", data: "!", wantErr: errFault},
+			{op: "readat", data: "xxxx", wantErr: errFault},
+		},
+		wantBuf: "hellowor",
+	}, {
+		ff: &FaultFile{FailAfterCalls: 2},
+		ops: []testOp{
+			{op: "write", data: "hello", wantCnt: 5},
+			{op: "seek", off: 1},
+			{op: "sync", wantErr: syscall.EIO},
+			{op: "truncate", wantErr: syscall.EIO},
+		},
+		wantBuf: "hello",
+	}, {
+		ff: &FaultFile{FailAfterCalls: -1},
+		ops: []testOp{
+			{op: "write", data: "hello", wantErr: syscall.EIO},
+		},
+	}, {
+		ff: &FaultFile{ShortWrite: 3},
+		ops: []testOp{
+			{op: "write", data: "hello", wantCnt: 3, wantErr: io.ErrShortWrite},
+			{op: "write", data: "abc", wantCnt: 3},
+			{op: "writeat", data: "XYZW", off: 1, wantCnt: 3, wantErr: io.ErrShortWrite},
+		},
+		wantBuf: "hXYZbc",
+	}, {
+		ff: &FaultFile{SizeLimit: 6},
+		ops: []testOp{
+			{op: "write", data: "hello", wantCnt: 5},
+			{op: "write", data: "world", wantCnt: 1, wantErr: syscall.ENOSPC},
+			{op: "writeat", data: "HE", off: 0, wantCnt: 2},
+			{op: "writeat", data: "!", off: 10, wantErr: syscall.ENOSPC},
+			{op: "truncate", off: 7, wantErr: syscall.ENOSPC},
+			{op: "truncate", off: 4},
+			{op: "read", data: "xxxxxx", wantCnt: 0, wantErr: io.EOF},
+			{op: "seek", off: 0},
+			{op: "read", data: "xxxxxx", wantCnt: 4, wantData: "HEll", wantErr: io.EOF},
+		},
+		wantBuf: "HEll",
+	}, {
+		ff: &FaultFile{Latency: time.Millisecond},
+		ops: []testOp{
+			{op: "write", data: "hello", wantCnt: 5},
+		},
+		wantBuf: "hello",
+	}}
+
+	for i, tt := range tests {
+		ff := tt.ff
+		ff.File = new(File)
+		for j, op := range tt.ops {
+			var gotCnt int
+			var gotData string
+			var gotErr error
+			switch op.op {
+			case "read":
+				b := make([]byte, len(op.data))
+				gotCnt, gotErr = readFull(ff, b)
+				gotData = string(b[:gotCnt])
+			case "readat":
+				b := make([]byte, len(op.data))
+				gotCnt, gotErr = ff.ReadAt(b, op.off)
+				gotData = string(b[:gotCnt])
+			case "write":
+				gotCnt, gotErr = ff.Write([]byte(op.data))
+			case "writeat":
+				gotCnt, gotErr = ff.WriteAt([]byte(op.data), op.off)
+			case "seek":
+				_, gotErr = ff.Seek(op.off, io.SeekStart)
+			case "truncate":
+				gotErr = ff.Truncate(op.off)
+			case "sync":
+				gotErr = ff.Sync()
+			}
+			if gotCnt != op.wantCnt || gotData != op.wantData || !errors.Is(gotErr, op.wantErr) {
+				t.Errorf("test %d, op %d, %s:\ngot  (%d, %q, %v)\nwant (%d, %q, %v)", i, j, op.op, gotCnt, gotData, gotErr, op.wantCnt, op.wantData, op.wantErr)
+			}
+		}
+		if got := string(ff.Bytes()); got != tt.wantBuf {
+			t.Errorf("test %d, Bytes() = %q, want %q", i, got, tt.wantBuf)
+		}
+	}
+}
+
+func TestFaultFileConcurrent(t *testing.T) {
+	// Concurrent operations must never exceed FailAfterBytes in total.
+	ff := &FaultFile{File: new(File), FailAfterBytes: 100}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				ff.Write([]byte("hello"))
+				ff.ReadAt(make([]byte, 5), 0)
+			}
+		}()
+	}
+	wg.Wait()
+	if ff.bytes != ff.FailAfterBytes {
+		t.Errorf("bytes transferred = %d, want %d", ff.bytes, ff.FailAfterBytes)
+	}
+}
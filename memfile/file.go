@@ -8,17 +8,56 @@ package memfile
 import (
 	"errors"
 	"io"
+	"io/fs"
+	"os"
+	"path"
 	"sync"
+	"syscall"
+	"time"
 )
 
-var errInvalid = errors.New("invalid argument")
+var (
+	errInvalid             = errors.New("invalid argument")
+	errWriteAtInAppendMode = errors.New("invalid use of WriteAt on file opened with O_APPEND")
+)
+
+// defaultPerm is the permission bits reported for a File that was never
+// the target of a Chmod call.
+const defaultPerm fs.FileMode = 0666
 
 // File is an in-memory emulation of the I/O operations of os.File.
 // The zero value for File is an empty file ready to use.
+//
+// Multiple handles to the same underlying contents may be obtained with
+// Open, where each handle has its own offset, open flags, and closed state.
 type File struct {
-	m sync.Mutex
-	b []byte
-	i int
+	// Fields shared by all handles; only used in the base File.
+	m       sync.RWMutex
+	b       []byte
+	shared  bool  // b is referenced by a view and must be copied before writing
+	chunked *File // chunked storage aliasing b for Clone; nil once b changes
+	mode    fs.FileMode
+	modeSet bool // mode is valid; otherwise defaultPerm is used
+	modTime time.Time
+
+	// Fields for sparse storage; only used if chunkSize is positive.
+	chunkSize int
+	chunks    map[int64][]byte // chunk index to chunk of chunkSize bytes
+	owned     map[int64]bool   // chunks not shared with any other File
+	pinned    map[int64]bool   // owned chunks referenced by views; nil if none
+	n         int64            // logical size of the contents
+
+	locks    *lockState // advisory locks held by handles; nil if never locked
+	readOnly bool       // contents may not be opened for writing; set by Snapshot
+
+	// Fields specific to this handle.
+	root    *File // File that holds the contents; nil if this File itself
+	i       int
+	name    string
+	closed  bool
+	noRead  bool // opened with os.O_WRONLY
+	noWrite bool // opened with os.O_RDONLY
+	append  bool // opened with os.O_APPEND
 }
 
 // New creates and initializes a new File using b as its initial contents.
@@ -27,34 +66,212 @@ func New(b []byte) *File {
 	return &File{b: b}
 }
 
+// NewFile is like New, but also names the File.
+// The name is reported by the Name and Stat methods.
+func NewFile(name string, b []byte) *File {
+	return &File{b: b, name: name}
+}
+
+// base returns the File that holds the contents shared by all handles.
+func (fb *File) base() *File {
+	if fb.root != nil {
+		return fb.root
+	}
+	return fb
+}
+
+// Open returns a new handle to the contents of fb with its own offset,
+// which starts at zero. The flag is a combination of the os.O_RDONLY,
+// os.O_WRONLY, or os.O_RDWR access modes with the os.O_APPEND and os.O_TRUNC
+// flags, which have the same semantics as os.OpenFile.
+// Since the file already exists, os.O_CREATE is ignored unless combined
+// with os.O_EXCL, in which case an error wrapping fs.ErrExist is reported.
+func (fb *File) Open(flag int) (*File, error) {
+	return fb.open(fb.name, flag)
+}
+func (fb *File) open(name string, flag int) (*File, error) {
+	r := fb.base()
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	}
+	h := &File{root: r, name: name, append: flag&os.O_APPEND != 0}
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		h.noWrite = true
+	case os.O_WRONLY:
+		h.noRead = true
+	case os.O_RDWR:
+	default:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errInvalid}
+	}
+	if r.readOnly && (!h.noWrite || flag&os.O_TRUNC != 0) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	if flag&os.O_TRUNC != 0 && !h.noWrite {
+		r.truncate(0)
+	}
+	return h, nil
+}
+
+// checkClosed reports an os.ErrClosed error for op if the File is closed.
+func (fb *File) checkClosed(op string) error {
+	if fb.closed {
+		return &fs.PathError{Op: op, Path: fb.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+// checkRead reports an error for op if the File is not open for reading.
+func (fb *File) checkRead(op string) error {
+	if err := fb.checkClosed(op); err != nil {
+		return err
+	}
+	if fb.noRead {
+		return &fs.PathError{Op: op, Path: fb.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+// checkWrite reports an error for op if the File is not open for writing.
+func (fb *File) checkWrite(op string) error {
+	if err := fb.checkClosed(op); err != nil {
+		return err
+	}
+	if fb.noWrite {
+		return &fs.PathError{Op: op, Path: fb.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+// Name returns the name of the File as provided to NewFile.
+func (fb *File) Name() string {
+	return fb.name
+}
+
+// Stat returns the fs.FileInfo structure describing the File.
+func (fb *File) Stat() (fs.FileInfo, error) {
+	r := fb.base()
+	r.m.RLock()
+	defer r.m.RUnlock()
+	if err := fb.checkClosed("stat"); err != nil {
+		return nil, err
+	}
+	name := fb.name
+	if name != "" {
+		name = path.Base(name) // Base of an empty path is "."
+	}
+	return r.info(name), nil
+}
+func (fb *File) info(name string) fileInfo {
+	mode := defaultPerm
+	if fb.modeSet {
+		mode = fb.mode
+	}
+	return fileInfo{name: name, size: fb.size(), mode: mode, modTime: fb.modTime}
+}
+
+// Chmod changes the mode of the File to mode.
+// Only the permission bits and the setuid, setgid, and sticky bits are used.
+func (fb *File) Chmod(mode fs.FileMode) error {
+	r := fb.base()
+	r.m.Lock()
+	defer r.m.Unlock()
+	if err := fb.checkClosed("chmod"); err != nil {
+		return err
+	}
+	r.mode = mode & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	r.modeSet = true
+	return nil
+}
+
+// Sync commits the current contents of the File to stable storage,
+// which is a no-op for an in-memory file.
+func (fb *File) Sync() error {
+	r := fb.base()
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return fb.checkClosed("sync")
+}
+
+// Close closes the File and releases any locks held by it.
+// Subsequent I/O operations return an error wrapping os.ErrClosed.
+// The contents remain accessible through Bytes and other handles to the same File.
+func (fb *File) Close() error {
+	r := fb.base()
+	r.m.Lock()
+	defer r.m.Unlock()
+	if err := fb.checkClosed("close"); err != nil {
+		return err
+	}
+	fb.close()
+	return nil
+}
+
+// ReadDir always fails since a File is never a directory.
+func (fb *File) ReadDir(n int) ([]fs.DirEntry, error) {
+	r := fb.base()
+	r.m.RLock()
+	defer r.m.RUnlock()
+	if err := fb.checkClosed("readdir"); err != nil {
+		return nil, err
+	}
+	return nil, &fs.PathError{Op: "readdir", Path: fb.name, Err: syscall.ENOTDIR}
+}
+
 // Read reads up to len(b) bytes from the File.
 // It returns the number of bytes read and any error encountered.
 // At end of file, Read returns (0, io.EOF).
 func (fb *File) Read(b []byte) (int, error) {
-	fb.m.Lock()
-	defer fb.m.Unlock()
+	_, n, err := fb.read(b)
+	return n, err
+}
 
-	n, err := fb.readAt(b, int64(fb.i))
+// read is like Read, but also reports the offset read at.
+func (fb *File) read(b []byte) (off int64, n int, err error) {
+	r := fb.base()
+	r.m.Lock()
+	defer r.m.Unlock()
+	if err := fb.checkRead("read"); err != nil {
+		return 0, 0, err
+	}
+
+	off = int64(fb.i)
+	n, err = r.readAt(b, off)
 	fb.i += n
-	return n, err
+	return off, n, err
 }
 
 // ReadAt reads len(b) bytes from the File starting at byte offset.
 // It returns the number of bytes read and the error, if any.
 // At end of file, that error is io.EOF.
+// Concurrent calls to ReadAt do not block each other.
 func (fb *File) ReadAt(b []byte, offset int64) (int, error) {
-	fb.m.Lock()
-	defer fb.m.Unlock()
-	return fb.readAt(b, offset)
+	r := fb.base()
+	r.m.RLock()
+	defer r.m.RUnlock()
+	if err := fb.checkRead("read"); err != nil {
+		return 0, err
+	}
+	return r.readAt(b, offset)
 }
 func (fb *File) readAt(b []byte, off int64) (int, error) {
 	if off < 0 || int64(int(off)) < off {
 		return 0, errInvalid
 	}
-	if off > int64(len(fb.b)) {
+	size := fb.size()
+	if off > size {
 		return 0, io.EOF
 	}
-	n := copy(b, fb.b[off:])
+	var n int
+	if fb.chunkSize > 0 {
+		n = int(min64(int64(len(b)), size-off))
+		fb.sparseReadAt(b[:n], off)
+	} else {
+		n = copy(b, fb.b[off:])
+	}
 	if n < len(b) {
 		return n, io.EOF
 	}
@@ -65,28 +282,68 @@ func (fb *File) readAt(b []byte, off int64) (int, error) {
 // It returns the number of bytes written and an error, if any.
 // If the current file offset is past the io.EOF, then the space in-between are
 // implicitly filled with zero bytes.
+// If the File was opened with os.O_APPEND, then the data is always written
+// at the end of the File.
 func (fb *File) Write(b []byte) (int, error) {
-	fb.m.Lock()
-	defer fb.m.Unlock()
+	_, n, err := fb.write(b, nil)
+	return n, err
+}
 
-	n, err := fb.writeAt(b, int64(fb.i))
+// write is like Write, but also reports the offset written at.
+// If non-nil, limit is called with that offset while the lock is held,
+// and reports how many bytes of b may be written and the error to report
+// if that is less than len(b).
+func (fb *File) write(b []byte, limit func(off int64) (int, error)) (off int64, n int, err error) {
+	r := fb.base()
+	r.m.Lock()
+	defer r.m.Unlock()
+	if err := fb.checkWrite("write"); err != nil {
+		return 0, 0, err
+	}
+
+	if fb.append {
+		fb.i = int(r.size())
+	}
+	off = int64(fb.i)
+	m, errLimit := len(b), error(nil)
+	if limit != nil {
+		m, errLimit = limit(off)
+	}
+	n, err = r.writeAt(b[:m], off)
 	fb.i += n
-	return n, err
+	if err == nil && m < len(b) {
+		err = errLimit
+	}
+	return off, n, err
 }
 
 // WriteAt writes len(b) bytes to the File starting at byte offset.
 // It returns the number of bytes written and an error, if any.
 // If offset lies past io.EOF, then the space in-between are implicitly filled
 // with zero bytes.
+// WriteAt reports an error if the File was opened with os.O_APPEND.
 func (fb *File) WriteAt(b []byte, offset int64) (int, error) {
-	fb.m.Lock()
-	defer fb.m.Unlock()
-	return fb.writeAt(b, offset)
+	r := fb.base()
+	r.m.Lock()
+	defer r.m.Unlock()
+	if err := fb.checkWrite("write"); err != nil {
+		return 0, err
+	}
+	if fb.append {
+		return 0, &fs.PathError{Op: "writeat", Path: fb.name, Err: errWriteAtInAppendMode}
+	}
+	return r.writeAt(b, offset)
 }
 func (fb *File) writeAt(b []byte, off int64) (int, error) {
 	if off < 0 || int64(int(off)) < off {
 		return 0, errInvalid
 	}
+	fb.modTime = time.Now()
+	if fb.chunkSize > 0 {
+		fb.sparseWriteAt(b, off)
+		return len(b), nil
+	}
+	fb.unshare()
 	if off > int64(len(fb.b)) {
 		fb.truncate(off)
 	}
@@ -95,12 +352,38 @@ func (fb *File) writeAt(b []byte, off int64) (int, error) {
 	return len(b), nil
 }
 
+// WriteString is like Write, but writes the contents of string s.
+func (fb *File) WriteString(s string) (int, error) {
+	return fb.Write([]byte(s))
+}
+
+// The writeString, readFrom, and writeTo functions implement the WriteString,
+// ReadFrom, and WriteTo methods for wrappers of a File (e.g., FaultFile)
+// in terms of the wrapper's own Write and Read methods.
+// Without them, the methods promoted from the embedded File would operate on
+// the File directly and bypass the wrapper.
+func writeString(w io.Writer, s string) (int, error) {
+	return w.Write([]byte(s))
+}
+func readFrom(w io.Writer, r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
+func writeTo(r io.Reader, w io.Writer) (int64, error) {
+	return io.Copy(w, struct{ io.Reader }{r})
+}
+
 // Seek sets the offset for the next Read or Write on file with offset,
 // interpreted according to whence: 0 means relative to the origin of the file,
 // 1 means relative to the current offset, and 2 means relative to the end.
+// SeekData and SeekHole seek to the next data region or hole at or after
+// offset, and report an error wrapping syscall.ENXIO if there is none.
 func (fb *File) Seek(offset int64, whence int) (int64, error) {
-	fb.m.Lock()
-	defer fb.m.Unlock()
+	r := fb.base()
+	r.m.Lock()
+	defer r.m.Unlock()
+	if err := fb.checkClosed("seek"); err != nil {
+		return 0, err
+	}
 
 	var abs int64
 	switch whence {
@@ -109,7 +392,12 @@ func (fb *File) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekCurrent:
 		abs = int64(fb.i) + offset
 	case io.SeekEnd:
-		abs = int64(len(fb.b)) + offset
+		abs = r.size() + offset
+	case SeekData, SeekHole:
+		var err error
+		if abs, err = r.seekData(offset, whence == SeekHole); err != nil {
+			return 0, fb.seekError(err)
+		}
 	default:
 		return 0, errInvalid
 	}
@@ -122,27 +410,46 @@ func (fb *File) Seek(offset int64, whence int) (int64, error) {
 
 // Truncate changes the size of the file. It does not change the I/O offset.
 func (fb *File) Truncate(n int64) error {
-	fb.m.Lock()
-	defer fb.m.Unlock()
-	return fb.truncate(n)
+	r := fb.base()
+	r.m.Lock()
+	defer r.m.Unlock()
+	if err := fb.checkClosed("truncate"); err != nil {
+		return err
+	}
+	if fb.noWrite {
+		return &fs.PathError{Op: "truncate", Path: fb.name, Err: syscall.EINVAL}
+	}
+	return r.truncate(n)
 }
 func (fb *File) truncate(n int64) error {
 	switch {
 	case n < 0 || int64(int(n)) < n:
 		return errInvalid
+	case fb.chunkSize > 0:
+		fb.sparseTruncate(n)
 	case n <= int64(len(fb.b)):
-		fb.b = fb.b[:n]
-		return nil
+		fb.b = fb.b[:n] // Views are unaffected until the File grows again
+		fb.chunked = nil
 	default:
+		fb.unshare()
 		fb.b = append(fb.b, make([]byte, int(n)-len(fb.b))...)
-		return nil
 	}
+	fb.modTime = time.Now()
+	return nil
 }
 
 // Bytes returns the full contents of the File.
 // The result in only valid until the next Write, WriteAt, or Truncate call.
+// For a sparse File, the result is a newly allocated copy of the contents.
+// Use BytesCopy or Slice to obtain contents that remain valid.
 func (fb *File) Bytes() []byte {
-	fb.m.Lock()
-	defer fb.m.Unlock()
-	return fb.b
+	r := fb.base()
+	r.m.RLock()
+	defer r.m.RUnlock()
+	if r.chunkSize > 0 {
+		b := make([]byte, r.n)
+		r.sparseReadAt(b, 0)
+		return b
+	}
+	return r.b
 }
@@ -5,10 +5,15 @@
 package memfile
 
 import (
+	"bytes"
+	"errors"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -188,6 +193,148 @@ func TestFile(t *testing.T) {
 	}
 }
 
+func TestFileMethods(t *testing.T) {
+	ft, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(ft.Name())
+	fb := NewFile(ft.Name(), nil)
+
+	for _, f := range []interface {
+		io.ReadWriteSeeker
+		io.ReaderFrom
+		io.WriterTo
+		io.StringWriter
+		Name() string
+		Stat() (fs.FileInfo, error)
+		Chmod(fs.FileMode) error
+		ReadDir(int) ([]fs.DirEntry, error)
+		Sync() error
+		Close() error
+	}{fb, ft} {
+		if got := f.Name(); got != ft.Name() {
+			t.Errorf("%T.Name() = %q, want %q", f, got, ft.Name())
+		}
+		if n, err := f.WriteString("hello, "); n != 7 || err != nil {
+			t.Errorf("%T.WriteString() = (%d, %v), want (7, nil)", f, n, err)
+		}
+		if n, err := f.ReadFrom(strings.NewReader("world")); n != 5 || err != nil {
+			t.Errorf("%T.ReadFrom() = (%d, %v), want (5, nil)", f, n, err)
+		}
+		f.Seek(7, io.SeekStart)
+		var bb bytes.Buffer
+		if n, err := f.WriteTo(&bb); n != 5 || err != nil || bb.String() != "world" {
+			t.Errorf("%T.WriteTo() = (%d, %v, %q), want (5, nil, %q)", f, n, err, bb.String(), "world")
+		}
+		if err := f.Chmod(0600); err != nil {
+			t.Errorf("%T.Chmod() error: %v", f, err)
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatalf("%T.Stat() error: %v", f, err)
+		}
+		if fi.Name() != filepath.Base(ft.Name()) || fi.Size() != 12 || fi.Mode() != 0600 || fi.IsDir() {
+			t.Errorf("%T.Stat() = {%q, %d, %v}, want {%q, 12, %v}", f, fi.Name(), fi.Size(), fi.Mode(), filepath.Base(ft.Name()), fs.FileMode(0600))
+		}
+		if _, err := f.ReadDir(-1); !errors.Is(err, syscall.ENOTDIR) {
+			t.Errorf("%T.ReadDir() error = %v, want %v", f, err, syscall.ENOTDIR)
+		}
+		if err := f.Sync(); err != nil {
+			t.Errorf("%T.Sync() error: %v", f, err)
+		}
+		if err := f.Close(); err != nil {
+			t.Errorf("%T.Close() error: %v", f, err)
+		}
+
+		// All operations on a closed file fail with os.ErrClosed.
+		errs := map[string]error{"Close": f.Close(), "Sync": f.Sync(), "Chmod": f.Chmod(0644)}
+		_, errs["Read"] = f.Read(make([]byte, 1))
+		_, errs["Write"] = f.Write([]byte("x"))
+		_, errs["Seek"] = f.Seek(0, io.SeekStart)
+		_, errs["Stat"] = f.Stat()
+		for op, err := range errs {
+			if !errors.Is(err, os.ErrClosed) {
+				t.Errorf("%T.%s() after Close error = %v, want %v", f, op, err, os.ErrClosed)
+			}
+		}
+	}
+	if got := string(fb.Bytes()); got != "hello, world" {
+		t.Errorf("Bytes() = %q, want %q", got, "hello, world")
+	}
+
+	// An unnamed File has an empty name rather than the base of an empty path.
+	if fi, err := New(nil).Stat(); err != nil || fi.Name() != "" {
+		t.Errorf("New(nil).Stat() = (%v, %v), want name %q", fi, err, "")
+	}
+
+	// Names are slash-separated as in io/fs, regardless of the platform.
+	for name, want := range map[string]string{"dir/file.txt": "file.txt", `dir\file.txt`: `dir\file.txt`} {
+		if fi, err := NewFile(name, nil).Stat(); err != nil || fi.Name() != want {
+			t.Errorf("NewFile(%q).Stat() = (%v, %v), want name %q", name, fi, err, want)
+		}
+	}
+}
+
+func TestFileHandles(t *testing.T) {
+	ft, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(ft.Name())
+	ft.Close()
+	fb := NewFile(ft.Name(), nil)
+
+	type handle interface {
+		io.ReadWriteSeeker
+		io.WriterAt
+		Truncate(int64) error
+		Close() error
+	}
+	openOS := func(flag int) (handle, error) { return os.OpenFile(ft.Name(), flag, 0) }
+	openMem := func(flag int) (handle, error) { return fb.Open(flag) }
+	for _, open := range []func(int) (handle, error){openOS, openMem} {
+		wr, _ := open(os.O_WRONLY | os.O_TRUNC)
+		ap, _ := open(os.O_WRONLY | os.O_APPEND)
+		rd, _ := open(os.O_RDONLY)
+		_, errExcl := open(os.O_RDWR | os.O_CREATE | os.O_EXCL)
+
+		wr.Write([]byte("hello"))
+		ap.Write([]byte(", world")) // Appended despite its own offset of zero
+		wr.Write([]byte("HELLO"))   // Overwrites the appended data
+		ap.Seek(0, io.SeekStart)
+		ap.Write([]byte("!"))
+		_, errReadWO := wr.Read(make([]byte, 1))
+		_, errWriteRO := rd.Write([]byte("x"))
+		_, errWriteAtAP := ap.WriteAt([]byte("x"), 0)
+		errTruncRO := rd.Truncate(0)
+		got, _ := ioutil.ReadAll(rd)
+		wr.Close()
+		ap.Close()
+		rd.Close()
+
+		if string(got) != "helloHELLOld!" {
+			t.Errorf("%T contents = %q, want %q", rd, got, "helloHELLOld!")
+		}
+		for _, tt := range []struct {
+			op        string
+			got, want error
+		}{
+			{"OpenFile(O_EXCL)", errExcl, fs.ErrExist},
+			{"Read on O_WRONLY", errReadWO, syscall.EBADF},
+			{"Write on O_RDONLY", errWriteRO, syscall.EBADF},
+			{"WriteAt on O_APPEND", errWriteAtAP, nil},
+			{"Truncate on O_RDONLY", errTruncRO, syscall.EINVAL},
+		} {
+			if tt.want == nil && tt.got == nil {
+				t.Errorf("%T %s succeeded, want error", rd, tt.op)
+			} else if tt.want != nil && !errors.Is(tt.got, tt.want) {
+				t.Errorf("%T %s error = %v, want %v", rd, tt.op, tt.got, tt.want)
+			}
+		}
+	}
+}
+
 func readFull(r io.Reader, b []byte) (n int, err error) {
 	b0 := b
 	for len(b) > 0 && err == nil {
@@ -199,3 +346,51 @@ func readFull(r io.Reader, b []byte) (n int, err error) {
 	}
 	return len(b0) - len(b), err
 }
+
+func BenchmarkReadAt(b *testing.B) {
+	const size = 64 << 20
+	for _, bb := range []struct {
+		name   string
+		file   *File
+		writer bool
+	}{
+		{"Flat", New(make([]byte, size)), false},
+		{"Sparse", func() *File { f := NewSparse(DefaultChunkSize); f.Truncate(size); return f }(), false},
+		{"FlatWithWriter", New(make([]byte, size)), true},
+	} {
+		run := func(b *testing.B, parallel bool) {
+			if bb.writer {
+				done := make(chan struct{})
+				defer close(done)
+				go func() {
+					buf := make([]byte, 4096)
+					for {
+						select {
+						case <-done:
+							return
+						default:
+							bb.file.WriteAt(buf, size-int64(len(buf)))
+						}
+					}
+				}()
+			}
+			b.SetBytes(4096)
+			b.ResetTimer()
+			if !parallel {
+				buf := make([]byte, 4096)
+				for i := 0; i < b.N; i++ {
+					bb.file.ReadAt(buf, int64(i*4096)%size)
+				}
+				return
+			}
+			b.RunParallel(func(pb *testing.PB) {
+				buf := make([]byte, 4096)
+				for i := 0; pb.Next(); i++ {
+					bb.file.ReadAt(buf, int64(i*4096)%size)
+				}
+			})
+		}
+		b.Run(bb.name+"/Serial", func(b *testing.B) { run(b, false) })
+		b.Run(bb.name+"/Parallel", func(b *testing.B) { run(b, true) })
+	}
+}
@@ -0,0 +1,399 @@
+// Copyright 2017, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package memfile
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// accMode is the mask for the access mode bits of the open flags.
+const accMode = os.O_RDONLY | os.O_WRONLY | os.O_RDWR
+
+// FS is an in-memory file system of Files organized in a directory tree.
+// It implements fs.FS, fs.ReadDirFS, fs.StatFS, fs.SubFS, and fs.GlobFS,
+// and provides operations to modify the file system similar to package os.
+// The zero value for FS is an empty file system ready to use.
+//
+// Names are slash-separated paths as accepted by fs.ValidPath.
+// The root directory is named ".".
+type FS struct {
+	m    sync.Mutex
+	root *node
+}
+
+// node is a regular file or directory in the file system.
+type node struct {
+	name    string
+	mode    fs.FileMode
+	modTime time.Time
+	file    *File            // base File of a regular file
+	entries map[string]*node // entries of a directory
+}
+
+func newDirNode(name string, perm fs.FileMode) *node {
+	return &node{name: name, mode: fs.ModeDir | perm.Perm(), modTime: time.Now(), entries: make(map[string]*node)}
+}
+
+func (n *node) isDir() bool { return n.entries != nil }
+
+func (n *node) info() fs.FileInfo {
+	if n.file != nil {
+		n.file.m.RLock()
+		defer n.file.m.RUnlock()
+		return n.file.info(n.name)
+	}
+	return fileInfo{name: n.name, mode: n.mode, modTime: n.modTime}
+}
+
+// fileInfo implements fs.FileInfo.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fileInfo) Sys() interface{}   { return nil }
+
+func (fsys *FS) rootNode() *node {
+	if fsys.root == nil {
+		fsys.root = newDirNode(".", 0777)
+	}
+	return fsys.root
+}
+
+// lookup returns the node for the named path.
+// The lock must be held.
+func (fsys *FS) lookup(op, name string) (*node, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	n := fsys.rootNode()
+	if name == "." {
+		return n, nil
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !n.isDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		if n = n.entries[elem]; n == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return n, nil
+}
+
+// lookupParent returns the directory node that contains the named path.
+// The lock must be held.
+func (fsys *FS) lookupParent(op, name string) (*node, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	dir, err := fsys.lookup(op, path.Dir(name))
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: errors.Unwrap(err)}
+	}
+	if !dir.isDir() {
+		return nil, &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return dir, nil
+}
+
+// Open opens the named file or directory for reading.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates the named file, similar to os.Create.
+func (fsys *FS) Create(name string) (*File, error) {
+	f, err := fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return f.(*File), nil // Directories cannot be opened for writing
+}
+
+// OpenFile opens the named file with the specified flag (os.O_RDONLY etc.),
+// similar to os.OpenFile. If the file does not exist and the os.O_CREATE flag
+// is passed, it is created with mode perm.
+//
+// The returned fs.File for a regular file is a *File handle with its own
+// offset that shares contents with all other handles to the same file.
+// The returned fs.File for a directory implements fs.ReadDirFile.
+func (fsys *FS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	fsys.m.Lock()
+	defer fsys.m.Unlock()
+
+	n, err := fsys.lookup("open", name)
+	switch {
+	case err == nil:
+		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+		}
+	case errors.Is(err, fs.ErrNotExist) && flag&os.O_CREATE != 0:
+		dir, err := fsys.lookupParent("open", name)
+		if err != nil {
+			return nil, err
+		}
+		n = &node{name: path.Base(name), file: &File{modTime: time.Now()}}
+		n.file.Chmod(perm.Perm())
+		dir.entries[n.name] = n
+		dir.modTime = n.file.modTime
+	default:
+		return nil, err
+	}
+
+	if n.isDir() {
+		if flag&accMode != os.O_RDONLY {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		d := &dirHandle{fsys: fsys, node: n, name: name}
+		for _, e := range sortedEntries(n) {
+			d.entries = append(d.entries, fs.FileInfoToDirEntry(e.info()))
+		}
+		return d, nil
+	}
+	f, err := n.file.open(name, flag&^(os.O_CREATE|os.O_EXCL))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func sortedEntries(n *node) []*node {
+	var ns []*node
+	for _, e := range n.entries {
+		ns = append(ns, e)
+	}
+	sort.Slice(ns, func(i, j int) bool { return ns[i].name < ns[j].name })
+	return ns
+}
+
+// ReadDir reads the named directory and
+// returns a list of directory entries sorted by filename.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	fsys.m.Lock()
+	defer fsys.m.Unlock()
+	n, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.isDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	var ds []fs.DirEntry
+	for _, e := range sortedEntries(n) {
+		ds = append(ds, fs.FileInfoToDirEntry(e.info()))
+	}
+	return ds, nil
+}
+
+// Stat returns a fs.FileInfo describing the named file or directory.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	fsys.m.Lock()
+	defer fsys.m.Unlock()
+	n, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(), nil
+}
+
+// Sub returns an fs.FS corresponding to the subtree rooted at dir.
+func (fsys *FS) Sub(dir string) (fs.FS, error) {
+	return fs.Sub(plainFS{fsys}, dir)
+}
+
+// Glob returns the names of all files matching pattern,
+// with the same semantics as path.Match.
+func (fsys *FS) Glob(pattern string) ([]string, error) {
+	return fs.Glob(plainFS{fsys}, pattern)
+}
+
+// plainFS hides the Sub and Glob methods of FS so that the generic
+// implementations in package fs do not recursively call them.
+type plainFS struct{ fsys *FS }
+
+func (p plainFS) Open(name string) (fs.File, error)          { return p.fsys.Open(name) }
+func (p plainFS) ReadDir(name string) ([]fs.DirEntry, error) { return p.fsys.ReadDir(name) }
+func (p plainFS) Stat(name string) (fs.FileInfo, error)      { return p.fsys.Stat(name) }
+
+// Mkdir creates a new directory with the specified name and permission bits.
+func (fsys *FS) Mkdir(name string, perm fs.FileMode) error {
+	fsys.m.Lock()
+	defer fsys.m.Unlock()
+	dir, err := fsys.lookupParent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	base := path.Base(name)
+	if dir.entries[base] != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	dir.entries[base] = newDirNode(base, perm)
+	dir.modTime = time.Now()
+	return nil
+}
+
+// MkdirAll creates a directory named path, along with any necessary parents.
+// If path is already a directory, MkdirAll does nothing and returns nil.
+func (fsys *FS) MkdirAll(name string, perm fs.FileMode) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return nil
+	}
+	fsys.m.Lock()
+	defer fsys.m.Unlock()
+	n := fsys.rootNode()
+	for _, elem := range strings.Split(name, "/") {
+		e := n.entries[elem]
+		if e == nil {
+			e = newDirNode(elem, perm)
+			n.entries[elem] = e
+			n.modTime = e.modTime
+		}
+		if !e.isDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		n = e
+	}
+	return nil
+}
+
+// Remove removes the named file or empty directory.
+func (fsys *FS) Remove(name string) error {
+	fsys.m.Lock()
+	defer fsys.m.Unlock()
+	dir, err := fsys.lookupParent("remove", name)
+	if err != nil {
+		return err
+	}
+	base := path.Base(name)
+	switch n := dir.entries[base]; {
+	case n == nil:
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	case len(n.entries) > 0:
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(dir.entries, base)
+	dir.modTime = time.Now()
+	return nil
+}
+
+// Rename renames (moves) oldname to newname.
+// If newname already exists, Rename replaces it, provided that either both
+// are regular files or both are directories and newname is empty.
+func (fsys *FS) Rename(oldname, newname string) error {
+	fsys.m.Lock()
+	defer fsys.m.Unlock()
+	linkErr := func(err error) error {
+		if pe, ok := err.(*fs.PathError); ok {
+			err = pe.Err
+		}
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+
+	oldDir, err := fsys.lookupParent("rename", oldname)
+	if err != nil {
+		return linkErr(err)
+	}
+	newDir, err := fsys.lookupParent("rename", newname)
+	if err != nil {
+		return linkErr(err)
+	}
+	oldBase, newBase := path.Base(oldname), path.Base(newname)
+	n := oldDir.entries[oldBase]
+	if n == nil {
+		return linkErr(fs.ErrNotExist)
+	}
+	if oldname == newname {
+		return nil
+	}
+	if n.isDir() && strings.HasPrefix(newname, oldname+"/") {
+		return linkErr(fs.ErrInvalid) // cannot move a directory into itself
+	}
+	if m := newDir.entries[newBase]; m != nil {
+		switch {
+		case n.isDir() && !m.isDir():
+			return linkErr(syscall.ENOTDIR)
+		case !n.isDir() && m.isDir():
+			return linkErr(syscall.EISDIR)
+		case len(m.entries) > 0:
+			return linkErr(syscall.ENOTEMPTY)
+		}
+	}
+
+	now := time.Now()
+	delete(oldDir.entries, oldBase)
+	n.name = newBase
+	newDir.entries[newBase] = n
+	oldDir.modTime, newDir.modTime = now, now
+	return nil
+}
+
+// dirHandle is an open directory in a FS.
+type dirHandle struct {
+	fsys    *FS
+	node    *node
+	name    string
+	entries []fs.DirEntry // remaining entries to be read
+	closed  bool
+}
+
+func (d *dirHandle) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *dirHandle) ReadDir(n int) ([]fs.DirEntry, error) {
+	d.fsys.m.Lock()
+	defer d.fsys.m.Unlock()
+	if d.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: d.name, Err: fs.ErrClosed}
+	}
+	if n <= 0 || n > len(d.entries) {
+		if n > 0 && len(d.entries) == 0 {
+			return nil, io.EOF
+		}
+		n = len(d.entries)
+	}
+	ds := d.entries[:n:n]
+	d.entries = d.entries[n:]
+	return ds, nil
+}
+
+func (d *dirHandle) Stat() (fs.FileInfo, error) {
+	d.fsys.m.Lock()
+	defer d.fsys.m.Unlock()
+	if d.closed {
+		return nil, &fs.PathError{Op: "stat", Path: d.name, Err: fs.ErrClosed}
+	}
+	return d.node.info(), nil
+}
+
+func (d *dirHandle) Close() error {
+	d.fsys.m.Lock()
+	defer d.fsys.m.Unlock()
+	if d.closed {
+		return &fs.PathError{Op: "close", Path: d.name, Err: fs.ErrClosed}
+	}
+	d.closed = true
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2017, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package memfile
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	var fsys FS
+	mustWrite := func(name, data string) {
+		f, err := fsys.Create(name)
+		if err != nil {
+			t.Fatalf("Create(%q) error: %v", name, err)
+		}
+		if _, err := f.Write([]byte(data)); err != nil {
+			t.Fatalf("Write(%q) error: %v", name, err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatalf("Close(%q) error: %v", name, err)
+		}
+	}
+	if err := fsys.MkdirAll("a/b/c", 0755); err != nil {
+		t.Fatalf("MkdirAll error: %v", err)
+	}
+	if err := fsys.Mkdir("d", 0755); err != nil {
+		t.Fatalf("Mkdir error: %v", err)
+	}
+	mustWrite("hello.txt", "hello, world\n")
+	mustWrite("a/one", "1")
+	mustWrite("a/b/two", "22")
+	mustWrite("a/b/c/three", "333")
+
+	if err := fstest.TestFS(&fsys, "hello.txt", "a/one", "a/b/two", "a/b/c/three", "d"); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := fsys.Sub("a/b")
+	if err != nil {
+		t.Fatalf("Sub error: %v", err)
+	}
+	if err := fstest.TestFS(sub, "two", "c/three"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fsys.Glob("a/*/t*"); err != nil || len(got) != 1 || got[0] != "a/b/two" {
+		t.Errorf("Glob = (%q, %v), want ([a/b/two], nil)", got, err)
+	}
+}
+
+func TestFSOps(t *testing.T) {
+	var fsys FS
+	wantErr := func(name string, got, want error) {
+		t.Helper()
+		if !errors.Is(got, want) {
+			t.Errorf("%s error = %v, want %v", name, got, want)
+		}
+	}
+	readAll := func(name string) string {
+		t.Helper()
+		b, err := fs.ReadFile(&fsys, name)
+		if err != nil {
+			t.Fatalf("ReadFile(%q) error: %v", name, err)
+		}
+		return string(b)
+	}
+
+	// Open flags.
+	_, err := fsys.Open("missing")
+	wantErr("Open", err, fs.ErrNotExist)
+	_, err = fsys.Open("../escape")
+	wantErr("Open", err, fs.ErrInvalid)
+	f, err := fsys.OpenFile("file", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile error: %v", err)
+	}
+	f.(io.Writer).Write([]byte("hello"))
+	_, err = f.Read(make([]byte, 1))
+	wantErr("Read on O_WRONLY", err, syscall.EBADF)
+	f.Close()
+	_, err = f.(io.Writer).Write([]byte("x"))
+	wantErr("Write after Close", err, fs.ErrClosed)
+	_, err = fsys.OpenFile("file", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	wantErr("OpenFile with O_EXCL", err, fs.ErrExist)
+
+	f, _ = fsys.OpenFile("file", os.O_WRONLY|os.O_APPEND, 0)
+	f.(io.Seeker).Seek(0, io.SeekStart)
+	f.(io.Writer).Write([]byte(", world"))
+	f.Close()
+	if got := readAll("file"); got != "hello, world" {
+		t.Errorf("after O_APPEND, data = %q, want %q", got, "hello, world")
+	}
+	f, _ = fsys.Open("file")
+	_, err = f.(io.Writer).Write([]byte("x"))
+	wantErr("Write on O_RDONLY", err, syscall.EBADF)
+	f.Close()
+	f, _ = fsys.OpenFile("file", os.O_RDWR|os.O_TRUNC, 0)
+	f.Close()
+	if got := readAll("file"); got != "" {
+		t.Errorf("after O_TRUNC, data = %q, want empty", got)
+	}
+	if fi, err := fsys.Stat("file"); err != nil || fi.Mode() != 0644 {
+		t.Errorf("Stat = (%v, %v), want mode 0644", fi, err)
+	}
+
+	// Directory operations.
+	_, err = fsys.OpenFile("file/x", os.O_RDWR|os.O_CREATE, 0644)
+	wantErr("OpenFile under file", err, syscall.ENOTDIR)
+	_, err = fsys.OpenFile("nodir/x", os.O_RDWR|os.O_CREATE, 0644)
+	wantErr("OpenFile under missing dir", err, fs.ErrNotExist)
+	wantErr("Mkdir existing", fsys.Mkdir("file", 0755), fs.ErrExist)
+	wantErr("MkdirAll through file", fsys.MkdirAll("file/x", 0755), syscall.ENOTDIR)
+	fsys.MkdirAll("dir/sub", 0755)
+	_, err = fsys.OpenFile("dir", os.O_RDWR, 0)
+	wantErr("OpenFile dir for writing", err, syscall.EISDIR)
+	wantErr("Remove non-empty", fsys.Remove("dir"), syscall.ENOTEMPTY)
+	wantErr("Remove missing", fsys.Remove("missing"), fs.ErrNotExist)
+
+	// Rename.
+	wantErr("Rename into self", fsys.Rename("dir", "dir/sub/dir"), fs.ErrInvalid)
+	wantErr("Rename dir over file", fsys.Rename("dir", "file"), syscall.ENOTDIR)
+	wantErr("Rename file over dir", fsys.Rename("file", "dir"), syscall.EISDIR)
+	if err := fsys.Rename("file", "dir/sub/moved"); err != nil {
+		t.Fatalf("Rename error: %v", err)
+	}
+	if _, err := fsys.Stat("file"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat old name error = %v, want %v", err, fs.ErrNotExist)
+	}
+	if fi, err := fsys.Stat("dir/sub/moved"); err != nil || fi.Name() != "moved" {
+		t.Errorf("Stat new name = (%v, %v), want name moved", fi, err)
+	}
+	if err := fsys.Rename("dir", "renamed"); err != nil {
+		t.Fatalf("Rename error: %v", err)
+	}
+	if err := fsys.Remove("renamed/sub/moved"); err != nil {
+		t.Fatalf("Remove error: %v", err)
+	}
+	if err := fsys.Remove("renamed/sub"); err != nil {
+		t.Fatalf("Remove error: %v", err)
+	}
+	if ds, err := fsys.ReadDir("."); err != nil || len(ds) != 1 || ds[0].Name() != "renamed" {
+		t.Errorf("ReadDir = (%v, %v), want [renamed]", ds, err)
+	}
+}
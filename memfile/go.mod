@@ -1,3 +1,3 @@
 module github.com/dsnet/golib/memfile
 
-go 1.12
+go 1.17
@@ -0,0 +1,228 @@
+// Copyright 2017, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package memfile
+
+import (
+	"io/fs"
+	"math"
+	"sync"
+	"syscall"
+)
+
+// LockType is the type of an advisory lock.
+type LockType int
+
+const (
+	// SharedLock may be held by many handles at the same time.
+	SharedLock LockType = 1 + iota
+	// ExclusiveLock may only be held by one handle at a time.
+	ExclusiveLock
+)
+
+// lockState is the state of all advisory locks on a File.
+// Locks are owned by a handle, such that independent handles to the same File
+// contend with each other, similar to locks on an open file description.
+type lockState struct {
+	m      sync.Mutex
+	cond   sync.Cond
+	flocks map[*File]LockType
+	ranges []rangeLock
+}
+
+// rangeLock is a byte-range lock on [off, end).
+type rangeLock struct {
+	owner    *File
+	typ      LockType
+	off, end int64
+}
+
+func (l1 rangeLock) conflicts(l2 rangeLock) bool {
+	return l1.owner != l2.owner && l1.off < l2.end && l2.off < l1.end &&
+		(l1.typ == ExclusiveLock || l2.typ == ExclusiveLock)
+}
+
+// lockState returns the lock state, allocating it if necessary.
+func (fb *File) lockState() (*lockState, error) {
+	r := fb.base()
+	r.m.Lock()
+	defer r.m.Unlock()
+	if err := fb.checkClosed("lock"); err != nil {
+		return nil, err
+	}
+	if r.locks == nil {
+		r.locks = &lockState{flocks: make(map[*File]LockType)}
+		r.locks.cond.L = &r.locks.m
+	}
+	return r.locks, nil
+}
+
+// Lock acquires an advisory lock of the given type on the whole File,
+// similar to flock(2), blocking until the lock is available.
+// Closing the handle while blocked causes Lock to report an error
+// wrapping fs.ErrClosed.
+// A handle holding a lock may convert it to another type by locking again.
+// Similar to flock(2), if the conversion must wait, the existing lock is
+// released first, such that concurrent upgrades do not deadlock.
+// Whole-file locks do not interact with byte-range locks.
+func (fb *File) Lock(typ LockType) error {
+	return fb.flock(typ, true)
+}
+
+// TryLock is like Lock, but reports an error wrapping syscall.EWOULDBLOCK
+// instead of blocking if the lock is held by another handle.
+func (fb *File) TryLock(typ LockType) error {
+	return fb.flock(typ, false)
+}
+
+func (fb *File) flock(typ LockType, wait bool) error {
+	if typ != SharedLock && typ != ExclusiveLock {
+		return errInvalid
+	}
+	ls, err := fb.lockState()
+	if err != nil {
+		return err
+	}
+	ls.m.Lock()
+	defer ls.m.Unlock()
+	for {
+		if fb.closed {
+			return &fs.PathError{Op: "flock", Path: fb.name, Err: fs.ErrClosed}
+		}
+		available := true
+		for owner, t := range ls.flocks {
+			if owner != fb && (typ == ExclusiveLock || t == ExclusiveLock) {
+				available = false
+			}
+		}
+		if available {
+			ls.flocks[fb] = typ
+			ls.cond.Broadcast() // Downgrades may unblock others
+			return nil
+		}
+		if !wait {
+			return &fs.PathError{Op: "flock", Path: fb.name, Err: syscall.EWOULDBLOCK}
+		}
+		if _, ok := ls.flocks[fb]; ok {
+			delete(ls.flocks, fb)
+			ls.cond.Broadcast()
+		}
+		ls.cond.Wait()
+	}
+}
+
+// Unlock releases the whole-file lock held by this handle, if any.
+func (fb *File) Unlock() error {
+	ls, err := fb.lockState()
+	if err != nil {
+		return err
+	}
+	ls.m.Lock()
+	defer ls.m.Unlock()
+	delete(ls.flocks, fb)
+	ls.cond.Broadcast()
+	return nil
+}
+
+// LockRange acquires an advisory lock of the given type on n bytes starting
+// at off, similar to fcntl(2) with F_SETLKW if wait is true and F_SETLK
+// otherwise. If n is zero, the range extends indefinitely past the end of
+// the File. Locking a range replaces any locks held by this handle within
+// that range. If wait is false, a conflicting lock held by another handle
+// causes an error wrapping syscall.EAGAIN. Closing the handle while blocked
+// causes LockRange to report an error wrapping fs.ErrClosed.
+func (fb *File) LockRange(typ LockType, off, n int64, wait bool) error {
+	if typ != SharedLock && typ != ExclusiveLock {
+		return errInvalid
+	}
+	return fb.setRange(typ, off, n, wait)
+}
+
+// UnlockRange releases the locks held by this handle on n bytes starting
+// at off. If n is zero, the range extends indefinitely.
+func (fb *File) UnlockRange(off, n int64) error {
+	return fb.setRange(0, off, n, false)
+}
+
+// setRange sets the lock type of the range, where a zero typ unlocks it.
+func (fb *File) setRange(typ LockType, off, n int64, wait bool) error {
+	if off < 0 || n < 0 || off > math.MaxInt64-n {
+		return errInvalid
+	}
+	end := off + n
+	if n == 0 {
+		end = math.MaxInt64
+	}
+	ls, err := fb.lockState()
+	if err != nil {
+		return err
+	}
+	ls.m.Lock()
+	defer ls.m.Unlock()
+
+	want := rangeLock{owner: fb, typ: typ, off: off, end: end}
+	for typ != 0 {
+		if fb.closed {
+			return &fs.PathError{Op: "fcntl", Path: fb.name, Err: fs.ErrClosed}
+		}
+		available := true
+		for _, l := range ls.ranges {
+			if l.conflicts(want) {
+				available = false
+			}
+		}
+		if available {
+			break
+		}
+		if !wait {
+			return &fs.PathError{Op: "fcntl", Path: fb.name, Err: syscall.EAGAIN}
+		}
+		ls.cond.Wait()
+	}
+
+	// Remove the coverage of [off, end) from the locks held by this handle.
+	var ranges []rangeLock
+	for _, l := range ls.ranges {
+		if l.owner != fb || l.end <= off || end <= l.off {
+			ranges = append(ranges, l)
+			continue
+		}
+		if l.off < off {
+			ranges = append(ranges, rangeLock{fb, l.typ, l.off, off})
+		}
+		if end < l.end {
+			ranges = append(ranges, rangeLock{fb, l.typ, end, l.end})
+		}
+	}
+	if typ != 0 {
+		ranges = append(ranges, want)
+	}
+	ls.ranges = ranges
+	ls.cond.Broadcast()
+	return nil
+}
+
+// close marks the handle fb as closed and releases all locks held by it,
+// waking any of its calls blocked waiting for a lock.
+// The lock of the base File must be held. Since closed is then set while
+// holding both locks, waiters may check it while only holding ls.m.
+func (fb *File) close() {
+	ls := fb.base().locks
+	if ls == nil {
+		fb.closed = true
+		return
+	}
+	ls.m.Lock()
+	defer ls.m.Unlock()
+	fb.closed = true
+	delete(ls.flocks, fb)
+	var ranges []rangeLock
+	for _, l := range ls.ranges {
+		if l.owner != fb {
+			ranges = append(ranges, l)
+		}
+	}
+	ls.ranges = ranges
+	ls.cond.Broadcast()
+}
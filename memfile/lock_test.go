@@ -0,0 +1,114 @@
+// Copyright 2017, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package memfile
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	fb := new(File)
+	h1, _ := fb.Open(os.O_RDWR)
+	h2, _ := fb.Open(os.O_RDWR)
+	wantErr := func(name string, got, want error) {
+		t.Helper()
+		if !errors.Is(got, want) {
+			t.Errorf("%s error = %v, want %v", name, got, want)
+		}
+	}
+
+	// Shared locks are compatible, but exclusive locks are not.
+	wantErr("h1.TryLock(SharedLock)", h1.TryLock(SharedLock), nil)
+	wantErr("h2.TryLock(SharedLock)", h2.TryLock(SharedLock), nil)
+	wantErr("h2.TryLock(ExclusiveLock)", h2.TryLock(ExclusiveLock), syscall.EWOULDBLOCK)
+	wantErr("h1.Unlock()", h1.Unlock(), nil)
+	wantErr("h2.TryLock(ExclusiveLock)", h2.TryLock(ExclusiveLock), nil)
+	wantErr("h1.TryLock(SharedLock)", h1.TryLock(SharedLock), syscall.EWOULDBLOCK)
+	wantErr("fb.TryLock(ExclusiveLock)", fb.TryLock(ExclusiveLock), syscall.EWOULDBLOCK)
+	wantErr("h1.TryLock(0)", h1.TryLock(0), errInvalid)
+
+	// Lock blocks until the lock is released by closing the handle.
+	done := make(chan error)
+	go func() { done <- h1.Lock(ExclusiveLock) }()
+	select {
+	case <-done:
+		t.Fatal("Lock did not block")
+	case <-time.After(10 * time.Millisecond):
+	}
+	h2.Close()
+	wantErr("h1.Lock(ExclusiveLock)", <-done, nil)
+	wantErr("h2.TryLock(SharedLock)", h2.TryLock(SharedLock), os.ErrClosed)
+	h1.Unlock()
+
+	// Concurrent upgrades from shared to exclusive locks do not deadlock.
+	h2, _ = fb.Open(os.O_RDWR)
+	h1.Lock(SharedLock)
+	h2.Lock(SharedLock)
+	upgraded := make(chan error, 2)
+	for _, h := range []*File{h1, h2} {
+		go func(h *File) {
+			err := h.Lock(ExclusiveLock)
+			h.Unlock()
+			upgraded <- err
+		}(h)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-upgraded:
+			wantErr("Lock(ExclusiveLock)", err, nil)
+		case <-time.After(5 * time.Second):
+			t.Fatal("concurrent Lock(ExclusiveLock) upgrades deadlocked")
+		}
+	}
+	h2.Close()
+
+	// Byte-range locks conflict only when overlapping.
+	h2, _ = fb.Open(os.O_RDWR)
+	wantErr("h1.LockRange(ExclusiveLock, 10, 10)", h1.LockRange(ExclusiveLock, 10, 10, false), nil)
+	wantErr("h2.LockRange(ExclusiveLock, 0, 10)", h2.LockRange(ExclusiveLock, 0, 10, false), nil)
+	wantErr("h2.LockRange(SharedLock, 19, 2)", h2.LockRange(SharedLock, 19, 2, false), syscall.EAGAIN)
+	wantErr("h2.LockRange(SharedLock, 30, 0)", h2.LockRange(SharedLock, 30, 0, false), nil)
+	wantErr("h1.LockRange(SharedLock, 1<<40, 1)", h1.LockRange(SharedLock, 1<<40, 1, false), nil)
+	wantErr("h1.LockRange(ExclusiveLock, 1<<40, 1)", h1.LockRange(ExclusiveLock, 1<<40, 1, false), syscall.EAGAIN)
+
+	// Unlocking part of a range splits it.
+	wantErr("h1.UnlockRange(12, 2)", h1.UnlockRange(12, 2), nil)
+	wantErr("h2.LockRange(SharedLock, 12, 2)", h2.LockRange(SharedLock, 12, 2, false), nil)
+	wantErr("h2.LockRange(SharedLock, 11, 2)", h2.LockRange(SharedLock, 11, 2, false), syscall.EAGAIN)
+	wantErr("h2.LockRange(SharedLock, 14, 1)", h2.LockRange(SharedLock, 14, 1, false), syscall.EAGAIN)
+
+	// Converting a range lock replaces it.
+	wantErr("h1.LockRange(SharedLock, 10, 10)", h1.LockRange(SharedLock, 10, 10, false), nil)
+	wantErr("h2.LockRange(SharedLock, 11, 2)", h2.LockRange(SharedLock, 11, 2, false), nil)
+
+	// LockRange with wait blocks until the conflicting lock is released.
+	go func() { done <- h2.LockRange(ExclusiveLock, 15, 1, true) }()
+	select {
+	case <-done:
+		t.Fatal("LockRange did not block")
+	case <-time.After(10 * time.Millisecond):
+	}
+	h1.UnlockRange(0, 0)
+	wantErr("h2.LockRange(ExclusiveLock, 15, 1)", <-done, nil)
+	wantErr("h1.LockRange(SharedLock, -1, 1)", h1.LockRange(SharedLock, -1, 1, false), errInvalid)
+
+	// Closing a handle blocked on a lock wakes it with an error.
+	h3, _ := fb.Open(os.O_RDWR)
+	h1.Lock(ExclusiveLock)
+	go func() { done <- h3.Lock(SharedLock) }()
+	time.Sleep(10 * time.Millisecond)
+	h3.Close()
+	wantErr("h3.Lock(SharedLock)", <-done, fs.ErrClosed)
+	h3, _ = fb.Open(os.O_RDWR)
+	go func() { done <- h3.LockRange(ExclusiveLock, 15, 1, true) }()
+	time.Sleep(10 * time.Millisecond)
+	h3.Close()
+	wantErr("h3.LockRange(ExclusiveLock, 15, 1)", <-done, fs.ErrClosed)
+}
@@ -0,0 +1,187 @@
+// Copyright 2017, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package memfile
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// Whence values for Seek to find the next data region or hole,
+// with the same semantics as SEEK_DATA and SEEK_HOLE on Linux.
+const (
+	SeekData = 3
+	SeekHole = 4
+)
+
+// NewSparse creates a new empty File that stores its contents in fixed-size
+// chunks of chunkSize bytes. Chunks are only allocated when written to,
+// such that holes are implicitly zero and writing at a large offset
+// does not allocate memory for the gap before it.
+func NewSparse(chunkSize int) *File {
+	if chunkSize <= 0 {
+		panic("invalid chunk size")
+	}
+	return &File{chunkSize: chunkSize, chunks: make(map[int64][]byte), owned: make(map[int64]bool)}
+}
+
+// size reports the logical size of the contents.
+func (fb *File) size() int64 {
+	if fb.chunkSize > 0 {
+		return fb.n
+	}
+	return int64(len(fb.b))
+}
+
+// Footprint reports the number of bytes of memory allocated to hold
+// the contents of the File, which may be less than its size for a sparse File.
+// Chunks shared with other Files through Clone or Snapshot are not counted.
+func (fb *File) Footprint() int64 {
+	r := fb.base()
+	r.m.RLock()
+	defer r.m.RUnlock()
+	if r.chunkSize > 0 {
+		return int64(len(r.owned)) * int64(r.chunkSize)
+	}
+	return int64(cap(r.b))
+}
+
+// sparseReadAt copies contents starting at off into b, where off must be
+// within the file and b must not extend past the end of the file.
+func (fb *File) sparseReadAt(b []byte, off int64) {
+	cs := int64(fb.chunkSize)
+	for len(b) > 0 {
+		idx, pos := off/cs, off%cs
+		var n int
+		if c := fb.chunks[idx]; c != nil {
+			n = copy(b, c[pos:])
+		} else {
+			n = len(b)
+			if n > int(cs-pos) {
+				n = int(cs - pos)
+			}
+			for i := range b[:n] {
+				b[i] = 0
+			}
+		}
+		b, off = b[n:], off+int64(n)
+	}
+}
+
+func (fb *File) sparseWriteAt(b []byte, off int64) {
+	cs := int64(fb.chunkSize)
+	for len(b) > 0 {
+		idx, pos := off/cs, off%cs
+		n := copy(fb.ownChunk(idx)[pos:], b)
+		b, off = b[n:], off+int64(n)
+	}
+	if off > fb.n {
+		fb.n = off
+	}
+}
+
+func (fb *File) sparseTruncate(n int64) {
+	cs := int64(fb.chunkSize)
+	for idx, c := range fb.chunks {
+		switch {
+		case idx*cs >= n:
+			delete(fb.chunks, idx)
+			delete(fb.owned, idx)
+			delete(fb.pinned, idx)
+		case (idx+1)*cs > n && !allZeros(c[n-idx*cs:]):
+			zero := fb.ownChunk(idx)[n-idx*cs:]
+			for i := range zero {
+				zero[i] = 0
+			}
+		}
+	}
+	fb.n = n
+}
+
+// ownChunk returns the chunk at idx for writing, allocating it if it is a
+// hole and copying it if it is shared with another File or pinned by a view.
+func (fb *File) ownChunk(idx int64) []byte {
+	c := fb.chunks[idx]
+	if !fb.owned[idx] || fb.pinned[idx] {
+		if c == nil {
+			c = make([]byte, fb.chunkSize)
+		} else {
+			c = append([]byte(nil), c...)
+		}
+		fb.chunks[idx] = c
+		fb.owned[idx] = true
+		delete(fb.pinned, idx)
+	}
+	return c
+}
+
+func allZeros(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// seekData returns the offset of the next data region (or hole if hole is
+// true) at or after off. A non-sparse File is entirely data, with an
+// implicit hole at the end of the file.
+func (fb *File) seekData(off int64, hole bool) (int64, error) {
+	size := fb.size()
+	if off < 0 {
+		return 0, errInvalid
+	}
+	if off >= size {
+		return 0, syscall.ENXIO
+	}
+	if fb.chunkSize == 0 {
+		if hole {
+			return size, nil
+		}
+		return off, nil
+	}
+
+	cs := int64(fb.chunkSize)
+	if hole {
+		idx := off / cs
+		for fb.chunks[idx] != nil {
+			idx++
+		}
+		return min64(max64(off, idx*cs), size), nil
+	}
+	next := int64(-1)
+	for idx := range fb.chunks {
+		if (idx+1)*cs > off && (next < 0 || idx < next) {
+			next = idx
+		}
+	}
+	if next < 0 || next*cs >= size {
+		return 0, syscall.ENXIO
+	}
+	return max64(off, next*cs), nil
+}
+
+// seekError wraps an error from Seek, similar to os.File.
+func (fb *File) seekError(err error) error {
+	if err == errInvalid {
+		return err
+	}
+	return &fs.PathError{Op: "seek", Path: fb.name, Err: err}
+}
+
+func min64(x, y int64) int64 {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+func max64(x, y int64) int64 {
+	if x > y {
+		return x
+	}
+	return y
+}
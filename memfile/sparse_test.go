@@ -0,0 +1,85 @@
+// Copyright 2017, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package memfile
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"syscall"
+	"testing"
+)
+
+func TestSparse(t *testing.T) {
+	// Randomly apply the same operations to a flat and sparse File.
+	rnd := rand.New(rand.NewSource(0))
+	flat, sparse := new(File), NewSparse(7)
+	for i := 0; i < 10000; i++ {
+		off := rnd.Int63n(100)
+		switch rnd.Intn(3) {
+		case 0:
+			b := make([]byte, rnd.Intn(20))
+			rnd.Read(b)
+			flat.WriteAt(b, off)
+			sparse.WriteAt(b, off)
+		case 1:
+			flat.Truncate(off)
+			sparse.Truncate(off)
+		case 2:
+			b1, b2 := make([]byte, rnd.Intn(20)), make([]byte, 20)
+			n1, err1 := flat.ReadAt(b1, off)
+			n2, err2 := sparse.ReadAt(b2[:len(b1)], off)
+			if !bytes.Equal(b1[:n1], b2[:n2]) || err1 != err2 {
+				t.Fatalf("op %d, ReadAt(%d):\ngot  (%x, %v)\nwant (%x, %v)", i, off, b2[:n2], err2, b1[:n1], err1)
+			}
+		}
+		if !bytes.Equal(flat.Bytes(), sparse.Bytes()) {
+			t.Fatalf("op %d, Bytes():\ngot  %x\nwant %x", i, sparse.Bytes(), flat.Bytes())
+		}
+	}
+
+	// Writing at a large offset only allocates the written chunks.
+	fb := NewSparse(4096)
+	fb.WriteAt([]byte("hello"), 1<<40)
+	fb.WriteAt([]byte("world"), 1<<41)
+	if got, want := fb.Footprint(), int64(2*4096); got != want {
+		t.Errorf("Footprint() = %d, want %d", got, want)
+	}
+	b := make([]byte, 10)
+	if _, err := fb.ReadAt(b, 1<<40-5); err != nil || string(b) != "\x00\x00\x00\x00\x00hello" {
+		t.Errorf("ReadAt() = (%q, %v), want (%q, nil)", b, err, "\x00\x00\x00\x00\x00hello")
+	}
+
+	for _, tt := range []struct {
+		offset  int64
+		whence  int
+		wantPos int64
+		wantErr error
+	}{
+		{0, SeekData, 1 << 40 &^ 4095, nil},
+		{0, SeekHole, 0, nil},
+		{1<<40 + 1, SeekData, 1<<40 + 1, nil},
+		{1<<40 + 1, SeekHole, 1<<40&^4095 + 4096, nil},
+		{1<<40 + 4096, SeekData, 1 << 41, nil},
+		{1<<41 + 3, SeekHole, 1<<41 + 5, nil},
+		{1<<41 + 5, SeekData, 0, syscall.ENXIO},
+		{1<<41 + 5, SeekHole, 0, syscall.ENXIO},
+		{-1, SeekData, 0, errInvalid},
+	} {
+		gotPos, gotErr := fb.Seek(tt.offset, tt.whence)
+		if gotPos != tt.wantPos || !errors.Is(gotErr, tt.wantErr) {
+			t.Errorf("Seek(%d, %d) = (%d, %v), want (%d, %v)", tt.offset, tt.whence, gotPos, gotErr, tt.wantPos, tt.wantErr)
+		}
+	}
+
+	// A non-sparse File is entirely data.
+	fb = New([]byte("hello"))
+	if pos, err := fb.Seek(2, SeekData); pos != 2 || err != nil {
+		t.Errorf("Seek(2, SeekData) = (%d, %v), want (2, nil)", pos, err)
+	}
+	if pos, err := fb.Seek(2, SeekHole); pos != 5 || err != nil {
+		t.Errorf("Seek(2, SeekHole) = (%d, %v), want (5, nil)", pos, err)
+	}
+}
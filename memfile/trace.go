@@ -0,0 +1,168 @@
+// Copyright 2017, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package memfile
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Event is a record of a single I/O operation on a TraceFile.
+type Event struct {
+	// Op is the name of the operation, which is one of
+	// "Read", "ReadAt", "Write", "WriteAt", "Seek", or "Truncate".
+	Op string
+
+	// Offset is the file offset that the operation started at.
+	// For Seek, it is the requested offset, and for Truncate, the new size.
+	Offset int64
+	// Whence is the whence argument to Seek.
+	Whence int
+	// Length is the number of bytes requested to be read or written.
+	Length int
+	// Data is a copy of the data written by Write or WriteAt.
+	Data []byte
+
+	// N is the number of bytes read or written, or the resulting offset of Seek.
+	N int64
+	// Err is the error returned by the operation.
+	Err error
+}
+
+// String formats the Event for debugging.
+func (e Event) String() string {
+	switch e.Op {
+	case "Seek":
+		return fmt.Sprintf("Seek(%d, %d) = (%d, %v)", e.Offset, e.Whence, e.N, e.Err)
+	case "Truncate":
+		return fmt.Sprintf("Truncate(%d) = %v", e.Offset, e.Err)
+	default:
+		return fmt.Sprintf("%s(off:%d, len:%d) = (%d, %v)", e.Op, e.Offset, e.Length, e.N, e.Err)
+	}
+}
+
+// TraceFile wraps a File and records every Read, ReadAt, Write, WriteAt, Seek,
+// and Truncate operation performed through it.
+// All other methods are passed through to the underlying File.
+//
+// The events only record what was written, not the initial contents.
+// Thus, Replay can only reconstruct a File whose trace began while it was empty.
+type TraceFile struct {
+	*File
+
+	m      sync.Mutex
+	events []Event
+}
+
+// Events returns a copy of the events recorded so far.
+func (tf *TraceFile) Events() []Event {
+	tf.m.Lock()
+	defer tf.m.Unlock()
+	return append([]Event(nil), tf.events...)
+}
+
+// Read reads from the underlying File and records the operation.
+func (tf *TraceFile) Read(b []byte) (int, error) {
+	tf.m.Lock()
+	defer tf.m.Unlock()
+	off, n, err := tf.File.read(b)
+	tf.events = append(tf.events, Event{Op: "Read", Offset: off, Length: len(b), N: int64(n), Err: err})
+	return n, err
+}
+
+// ReadAt reads from the underlying File and records the operation.
+func (tf *TraceFile) ReadAt(b []byte, off int64) (int, error) {
+	tf.m.Lock()
+	defer tf.m.Unlock()
+	n, err := tf.File.ReadAt(b, off)
+	tf.events = append(tf.events, Event{Op: "ReadAt", Offset: off, Length: len(b), N: int64(n), Err: err})
+	return n, err
+}
+
+// Write writes to the underlying File and records the operation.
+func (tf *TraceFile) Write(b []byte) (int, error) {
+	tf.m.Lock()
+	defer tf.m.Unlock()
+	off, n, err := tf.File.write(b, nil)
+	data := append([]byte(nil), b[:n]...)
+	tf.events = append(tf.events, Event{Op: "Write", Offset: off, Length: len(b), Data: data, N: int64(n), Err: err})
+	return n, err
+}
+
+// WriteAt writes to the underlying File and records the operation.
+func (tf *TraceFile) WriteAt(b []byte, off int64) (int, error) {
+	tf.m.Lock()
+	defer tf.m.Unlock()
+	n, err := tf.File.WriteAt(b, off)
+	data := append([]byte(nil), b[:n]...)
+	tf.events = append(tf.events, Event{Op: "WriteAt", Offset: off, Length: len(b), Data: data, N: int64(n), Err: err})
+	return n, err
+}
+
+// WriteString writes s to the underlying File and records it as a Write.
+func (tf *TraceFile) WriteString(s string) (int, error) {
+	return writeString(tf, s)
+}
+
+// ReadFrom copies r to the underlying File and records each Write.
+func (tf *TraceFile) ReadFrom(r io.Reader) (int64, error) {
+	return readFrom(tf, r)
+}
+
+// WriteTo copies the underlying File to w and records each Read.
+func (tf *TraceFile) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(tf, w)
+}
+
+// Seek seeks the underlying File and records the operation.
+func (tf *TraceFile) Seek(offset int64, whence int) (int64, error) {
+	tf.m.Lock()
+	defer tf.m.Unlock()
+	pos, err := tf.File.Seek(offset, whence)
+	tf.events = append(tf.events, Event{Op: "Seek", Offset: offset, Whence: whence, N: pos, Err: err})
+	return pos, err
+}
+
+// Truncate truncates the underlying File and records the operation.
+func (tf *TraceFile) Truncate(n int64) error {
+	tf.m.Lock()
+	defer tf.m.Unlock()
+	err := tf.File.Truncate(n)
+	tf.events = append(tf.events, Event{Op: "Truncate", Offset: n, Err: err})
+	return err
+}
+
+// Replay applies the effects of the events to a new File,
+// such that both the contents and the offset of the returned File
+// match those of the traced File after the last event.
+//
+// Replay starts from an empty File, so the traced File must have been empty
+// when tracing began. Otherwise, bytes that were never written during
+// the trace are zero in the returned File instead of their original values.
+func Replay(events []Event) *File {
+	fb := new(File)
+	for _, e := range events {
+		if e.Err != nil && e.N == 0 && e.Op != "Seek" {
+			continue // Operation failed without any effect
+		}
+		switch e.Op {
+		case "Read":
+			fb.Seek(e.Offset+e.N, io.SeekStart)
+		case "Write":
+			fb.WriteAt(e.Data, e.Offset)
+			fb.Seek(e.Offset+int64(len(e.Data)), io.SeekStart)
+		case "WriteAt":
+			fb.WriteAt(e.Data, e.Offset)
+		case "Seek":
+			if e.Err == nil {
+				fb.Seek(e.N, io.SeekStart)
+			}
+		case "Truncate":
+			fb.Truncate(e.Offset)
+		}
+	}
+	return fb
+}
@@ -0,0 +1,80 @@
+// Copyright 2017, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package memfile
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestTraceFile(t *testing.T) {
+	h, _ := new(File).Open(os.O_RDWR | os.O_APPEND)
+	tf := &TraceFile{File: h}
+	tf.WriteString("hello")
+	tf.Seek(1, io.SeekStart)
+	tf.Read(make([]byte, 2))
+	tf.Write([]byte(", world"))
+	tf.WriteAt([]byte("x"), 0)
+	tf.Truncate(-1)
+
+	var got []string
+	for _, e := range tf.Events() {
+		got = append(got, e.String())
+	}
+	want := []string{
+		"Write(off:0, len:5) = (5, <nil>)",
+		"Seek(1, 0) = (1, <nil>)",
+		"Read(off:1, len:2) = (2, <nil>)",
+		"Write(off:5, len:7) = (7, <nil>)",
+		"WriteAt(off:0, len:1) = (0, writeat : invalid use of WriteAt on file opened with O_APPEND)",
+		"Truncate(-1) = invalid argument",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Events() = %q, want %q", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("event %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	rnd := rand.New(rand.NewSource(0))
+	tf := &TraceFile{File: new(File)}
+	for i := 0; i < 1000; i++ {
+		off := rnd.Int63n(100)
+		b := make([]byte, rnd.Intn(20))
+		switch rnd.Intn(7) {
+		case 0:
+			tf.Read(b)
+		case 1:
+			tf.ReadAt(b, off)
+		case 2:
+			tf.Write(b)
+		case 3:
+			tf.WriteAt(b, off)
+		case 4:
+			tf.Seek(off-10, rnd.Intn(3))
+		case 5:
+			tf.Truncate(off - 10)
+		case 6:
+			tf.ReadFrom(bytes.NewReader(b))
+		}
+	}
+
+	fb := Replay(tf.Events())
+	if !bytes.Equal(fb.Bytes(), tf.Bytes()) {
+		t.Errorf("Replay() contents mismatch")
+	}
+	gotPos, _ := fb.Seek(0, io.SeekCurrent)
+	wantPos, _ := tf.File.Seek(0, io.SeekCurrent)
+	if gotPos != wantPos {
+		t.Errorf("Replay() offset = %d, want %d", gotPos, wantPos)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2017, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package memfile
+
+import (
+	"io"
+	"time"
+)
+
+// readFromSize is the initial buffer size used by ReadFrom for a non-sparse
+// File, which doubles after every read up to readFromMaxSize.
+const (
+	readFromSize    = 32 << 10
+	readFromMaxSize = 4 << 20
+)
+
+// BytesCopy returns a copy of the full contents of the File.
+func (fb *File) BytesCopy() []byte {
+	r := fb.base()
+	r.m.RLock()
+	defer r.m.RUnlock()
+	b := make([]byte, r.size())
+	r.readAt(b, 0)
+	return b
+}
+
+// Slice returns a read-only view of n bytes of the contents starting at off.
+// The view is pinned such that subsequent writes to the File copy
+// the underlying storage instead of modifying the view.
+// The view must not be modified.
+//
+// If the range extends past the end of the File, Slice returns the
+// available contents and io.EOF. The view is a newly allocated copy if
+// it spans multiple chunks of a sparse File.
+func (fb *File) Slice(off, n int64) ([]byte, error) {
+	r := fb.base()
+	r.m.Lock()
+	defer r.m.Unlock()
+	if err := fb.checkRead("read"); err != nil {
+		return nil, err
+	}
+	if off < 0 || n < 0 || int64(int(off)) < off || int64(int(n)) < n {
+		return nil, errInvalid
+	}
+
+	var err error
+	if size := r.size(); off >= size || n > size-off {
+		n, err = max64(0, size-off), io.EOF
+	}
+	if r.chunkSize == 0 {
+		r.shared = true
+		return r.b[off : off+n : off+n], err
+	}
+	cs := int64(r.chunkSize)
+	if idx, pos := off/cs, off%cs; pos+n <= cs && r.chunks[idx] != nil {
+		r.pinChunk(idx)
+		return r.chunks[idx][pos : pos+n : pos+n], err
+	}
+	b := make([]byte, n)
+	r.sparseReadAt(b, off)
+	return b, err
+}
+
+// unshare ensures that the storage of a non-sparse File is not referenced
+// by any views returned by Slice or WriteTo. The lock must be held.
+func (fb *File) unshare() {
+	if fb.shared {
+		fb.b = append([]byte(nil), fb.b...)
+		fb.shared = false
+		fb.chunked = nil
+	}
+}
+
+// WriteTo implements io.WriterTo by writing the contents of the File
+// from the current offset until io.EOF to w.
+// The contents are passed to w directly without an intermediate copy.
+func (fb *File) WriteTo(w io.Writer) (int64, error) {
+	r := fb.base()
+	r.m.Lock()
+	if err := fb.checkRead("read"); err != nil {
+		r.m.Unlock()
+		return 0, err
+	}
+	views := r.pin(int64(fb.i))
+	r.m.Unlock()
+
+	var cnt int64
+	var err error
+	for _, b := range views {
+		var n int
+		n, err = w.Write(b)
+		cnt += int64(n)
+		if err != nil {
+			break
+		}
+	}
+
+	r.m.Lock()
+	fb.i += int(cnt)
+	r.m.Unlock()
+	return cnt, err
+}
+
+// pin returns read-only views of the contents from off until io.EOF.
+// The lock must be held.
+func (fb *File) pin(off int64) [][]byte {
+	size := fb.size()
+	if off >= size {
+		return nil
+	}
+	if fb.chunkSize == 0 {
+		fb.shared = true
+		return [][]byte{fb.b[off:size:size]}
+	}
+
+	var views [][]byte
+	var zeros []byte
+	cs := int64(fb.chunkSize)
+	for off < size {
+		idx, pos := off/cs, off%cs
+		end := min64(cs, size-idx*cs)
+		c := fb.chunks[idx]
+		if c == nil {
+			if zeros == nil {
+				zeros = make([]byte, cs)
+			}
+			c = zeros
+		} else {
+			fb.pinChunk(idx)
+		}
+		views = append(views, c[pos:end:end])
+		off += end - pos
+	}
+	return views
+}
+
+// pinChunk marks the chunk at idx as referenced by a view, such that
+// subsequent writes copy it. The chunk is still counted by Footprint
+// since it remains owned by this File. The lock must be held.
+func (fb *File) pinChunk(idx int64) {
+	if fb.owned[idx] {
+		if fb.pinned == nil {
+			fb.pinned = make(map[int64]bool)
+		}
+		fb.pinned[idx] = true
+	}
+}
+
+// ReadFrom implements io.ReaderFrom by writing the contents of r
+// to the File at the current offset until io.EOF.
+// When possible, the buffers read into are adopted as the storage of the File
+// instead of being copied.
+func (fb *File) ReadFrom(rd io.Reader) (int64, error) {
+	r := fb.base()
+	var cnt int64
+	var buf []byte
+	for {
+		r.m.RLock()
+		err := fb.checkWrite("write")
+		size := r.chunkSize
+		r.m.RUnlock()
+		if err != nil {
+			return cnt, err
+		}
+		if size == 0 {
+			size = readFromSize
+			if len(buf) > 0 {
+				size = int(min64(2*int64(len(buf)), readFromMaxSize))
+			}
+		}
+		if len(buf) != size {
+			buf = make([]byte, size)
+		}
+
+		n, err := rd.Read(buf)
+		if n > 0 {
+			r.m.Lock()
+			if fb.append {
+				fb.i = int(r.size())
+			}
+			if r.adopt(buf[:n], int64(fb.i)) {
+				buf = nil
+			}
+			fb.i += n
+			r.m.Unlock()
+			cnt += int64(n)
+		}
+		switch {
+		case err == io.EOF:
+			return cnt, nil
+		case err != nil:
+			return cnt, err
+		}
+	}
+}
+
+// adopt writes b at off, reporting whether b itself was taken as storage,
+// in which case the caller must not use it any further. The lock must be held.
+func (fb *File) adopt(b []byte, off int64) bool {
+	switch cs := int64(fb.chunkSize); {
+	case cs == 0 && off == 0 && len(fb.b) == 0:
+		fb.b, fb.shared, fb.chunked = b, false, nil
+	case cs > 0 && off%cs == 0 && int64(len(b)) == cs:
+		fb.chunks[off/cs] = b
+		fb.owned[off/cs] = true
+		delete(fb.pinned, off/cs)
+		fb.n = max64(fb.n, off+cs)
+	default:
+		fb.writeAt(b, off)
+		return false
+	}
+	fb.modTime = time.Now()
+	return true
+}
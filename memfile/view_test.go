@@ -0,0 +1,98 @@
+// Copyright 2017, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package memfile
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestViews(t *testing.T) {
+	for _, fb := range []*File{New(nil), NewSparse(4)} {
+		fb.Write([]byte("hello, world"))
+
+		b := fb.BytesCopy()
+		whole, err1 := fb.Slice(0, 12)
+		within, err2 := fb.Slice(1, 3)
+		tail, err3 := fb.Slice(10, 5)
+		if err1 != nil || err2 != nil || err3 != io.EOF {
+			t.Errorf("Slice() errors = (%v, %v, %v), want (nil, nil, %v)", err1, err2, err3, io.EOF)
+		}
+		if _, err := fb.Slice(-1, 1); err != errInvalid {
+			t.Errorf("Slice(-1, 1) error = %v, want %v", err, errInvalid)
+		}
+
+		// Modifying the File does not affect the pinned views.
+		fb.WriteAt([]byte("HELLO, WORLD"), 0)
+		fb.Truncate(2)
+		fb.Truncate(12)
+		if got := string(b) + "|" + string(whole) + "|" + string(within) + "|" + string(tail); got != "hello, world|hello, world|ell|ld" {
+			t.Errorf("%T views = %q, want %q", fb, got, "hello, world|hello, world|ell|ld")
+		}
+		if got, want := string(fb.Bytes()), "HE"+strings.Repeat("\x00", 10); got != want {
+			t.Errorf("%T Bytes() = %q, want %q", fb, got, want)
+		}
+
+		// WriteTo passes pinned views of the contents.
+		var views [][]byte
+		fb.Seek(1, io.SeekStart)
+		n, err := fb.WriteTo(writerFunc(func(b []byte) (int, error) {
+			views = append(views, b)
+			return len(b), nil
+		}))
+		fb.WriteAt([]byte("xxxxxxxxxxxx"), 0)
+		if got := string(bytes.Join(views, nil)); n != 11 || err != nil || got != "E"+strings.Repeat("\x00", 10) {
+			t.Errorf("%T WriteTo() = (%d, %v, %q), want (11, nil, %q)", fb, n, err, got, "E"+strings.Repeat("\x00", 10))
+		}
+		if pos, _ := fb.Seek(0, io.SeekCurrent); pos != 12 {
+			t.Errorf("%T offset after WriteTo = %d, want 12", fb, pos)
+		}
+
+		// ReadFrom writes at the current offset.
+		fb.Seek(4, io.SeekStart)
+		if n, err := fb.ReadFrom(strings.NewReader("abcdefghij")); n != 10 || err != nil {
+			t.Errorf("%T ReadFrom() = (%d, %v), want (10, nil)", fb, n, err)
+		}
+		if got, want := string(fb.Bytes()), "xxxxabcdefghij"; got != want {
+			t.Errorf("%T Bytes() = %q, want %q", fb, got, want)
+		}
+	}
+
+	// Pinned chunks are still counted by Footprint, and are copied on write.
+	fb := NewSparse(4096)
+	fb.WriteAt(make([]byte, 2*4096), 0)
+	view, _ := fb.Slice(0, 4)
+	if got := fb.Footprint(); got != 2*4096 {
+		t.Errorf("Footprint() after Slice = %d, want %d", got, 2*4096)
+	}
+	fb.WriteTo(io.Discard)
+	if got := fb.Footprint(); got != 2*4096 {
+		t.Errorf("Footprint() after WriteTo = %d, want %d", got, 2*4096)
+	}
+	fb.WriteAt([]byte("abcd"), 0)
+	if got := fb.Footprint(); got != 2*4096 || string(view) != "\x00\x00\x00\x00" {
+		t.Errorf("Footprint() after write = %d with view %q, want %d with view unmodified", got, view, 2*4096)
+	}
+
+	// ReadFrom adopts the read buffers as storage where possible.
+	fb = NewSparse(4096)
+	data := strings.Repeat("0123456789abcdef", 1<<12)
+	if n, err := fb.ReadFrom(strings.NewReader(data)); n != int64(len(data)) || err != nil {
+		t.Errorf("ReadFrom() = (%d, %v), want (%d, nil)", n, err, len(data))
+	}
+	if string(fb.Bytes()) != data || fb.Footprint() != int64(len(data)) {
+		t.Errorf("ReadFrom() mismatching data or footprint %d", fb.Footprint())
+	}
+	fb = New(nil)
+	if n, err := fb.ReadFrom(strings.NewReader(data)); n != int64(len(data)) || err != nil || string(fb.Bytes()) != data {
+		t.Errorf("ReadFrom() = (%d, %v), want (%d, nil)", n, err, len(data))
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) { return f(b) }
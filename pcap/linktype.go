@@ -0,0 +1,285 @@
+// Copyright 2022, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package pcap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// LinkType specifies the type of each Packet.Data.
+// See https://www.tcpdump.org/linktypes.html for the registered values.
+type LinkType uint32
+
+const (
+	NullLinkType                  LinkType = 0   // BSD loopback; 4-byte host-endian address family
+	EthernetLinkType              LinkType = 1   // ethernet; IEEE 802.3
+	PPPLinkType                   LinkType = 9   // PPP; RFC 1661
+	FDDILinkType                  LinkType = 10  // FDDI; ANSI X3T9.5
+	PPPHDLCLinkType               LinkType = 50  // PPP in HDLC-like framing; RFC 1662
+	RawLinkType                   LinkType = 101 // raw IP; either IPv4 or IPv6
+	CiscoHDLCLinkType             LinkType = 104 // Cisco HDLC
+	IEEE80211LinkType             LinkType = 105 // wireless; IEEE 802.11
+	FrameRelayLinkType            LinkType = 107 // frame relay
+	LoopLinkType                  LinkType = 108 // OpenBSD loopback; 4-byte big-endian address family
+	LinuxSLLLinkType              LinkType = 113 // Linux cooked capture, version 1
+	PFLogLinkType                 LinkType = 117 // OpenBSD pflog
+	IEEE80211PrismLinkType        LinkType = 119 // IEEE 802.11 with Prism header
+	IEEE80211RadiotapLinkType     LinkType = 127 // IEEE 802.11 with radiotap header
+	IEEE80211AVSLinkType          LinkType = 163 // IEEE 802.11 with AVS header
+	BluetoothHCIH4LinkType        LinkType = 187 // Bluetooth HCI UART transport layer
+	USBLinuxLinkType              LinkType = 189 // Linux USB with 48-byte header
+	PPILinkType                   LinkType = 192 // Per-Packet Information header
+	IEEE802154LinkType            LinkType = 195 // IEEE 802.15.4 with FCS
+	ERFLinkType                   LinkType = 197 // Endace Extensible Record Format
+	USBLinuxMmappedLinkType       LinkType = 220 // Linux USB with 64-byte header
+	IPNetLinkType                 LinkType = 226 // Solaris ipnet
+	CANSocketCANLinkType          LinkType = 227 // Linux SocketCAN
+	IPv4LinkType                  LinkType = 228 // raw IPv4
+	IPv6LinkType                  LinkType = 229 // raw IPv6
+	NFLogLinkType                 LinkType = 239 // Linux netfilter log
+	MPEG2TSLinkType               LinkType = 243 // MPEG-2 transport stream
+	InfiniBandLinkType            LinkType = 247 // InfiniBand
+	SCTPLinkType                  LinkType = 248 // SCTP without a lower-level header
+	USBPcapLinkType               LinkType = 249 // Windows USBPcap
+	BluetoothLELLLinkType         LinkType = 251 // Bluetooth Low Energy link layer
+	NetlinkLinkType               LinkType = 253 // Linux netlink
+	BluetoothLinuxMonitorLinkType LinkType = 254 // Linux Bluetooth monitor
+	PKTAPLinkType                 LinkType = 258 // Apple PKTAP
+	USBDarwinLinkType             LinkType = 266 // macOS USB
+	VSockLinkType                 LinkType = 271 // virtual socket
+	NordicBLELinkType             LinkType = 272 // Nordic Semiconductor BLE sniffer
+	LinuxSLL2LinkType             LinkType = 276 // Linux cooked capture, version 2
+	USB20LinkType                 LinkType = 288 // USB 2.0 packets
+)
+
+// linkTypeGoNames maps each LinkType constant to its Go identifier.
+var linkTypeGoNames = map[LinkType]string{
+	NullLinkType:                  "NullLinkType",
+	EthernetLinkType:              "EthernetLinkType",
+	PPPLinkType:                   "PPPLinkType",
+	FDDILinkType:                  "FDDILinkType",
+	PPPHDLCLinkType:               "PPPHDLCLinkType",
+	RawLinkType:                   "RawLinkType",
+	CiscoHDLCLinkType:             "CiscoHDLCLinkType",
+	IEEE80211LinkType:             "IEEE80211LinkType",
+	FrameRelayLinkType:            "FrameRelayLinkType",
+	LoopLinkType:                  "LoopLinkType",
+	LinuxSLLLinkType:              "LinuxSLLLinkType",
+	PFLogLinkType:                 "PFLogLinkType",
+	IEEE80211PrismLinkType:        "IEEE80211PrismLinkType",
+	IEEE80211RadiotapLinkType:     "IEEE80211RadiotapLinkType",
+	IEEE80211AVSLinkType:          "IEEE80211AVSLinkType",
+	BluetoothHCIH4LinkType:        "BluetoothHCIH4LinkType",
+	USBLinuxLinkType:              "USBLinuxLinkType",
+	PPILinkType:                   "PPILinkType",
+	IEEE802154LinkType:            "IEEE802154LinkType",
+	ERFLinkType:                   "ERFLinkType",
+	USBLinuxMmappedLinkType:       "USBLinuxMmappedLinkType",
+	IPNetLinkType:                 "IPNetLinkType",
+	CANSocketCANLinkType:          "CANSocketCANLinkType",
+	IPv4LinkType:                  "IPv4LinkType",
+	IPv6LinkType:                  "IPv6LinkType",
+	NFLogLinkType:                 "NFLogLinkType",
+	MPEG2TSLinkType:               "MPEG2TSLinkType",
+	InfiniBandLinkType:            "InfiniBandLinkType",
+	SCTPLinkType:                  "SCTPLinkType",
+	USBPcapLinkType:               "USBPcapLinkType",
+	BluetoothLELLLinkType:         "BluetoothLELLLinkType",
+	NetlinkLinkType:               "NetlinkLinkType",
+	BluetoothLinuxMonitorLinkType: "BluetoothLinuxMonitorLinkType",
+	PKTAPLinkType:                 "PKTAPLinkType",
+	USBDarwinLinkType:             "USBDarwinLinkType",
+	VSockLinkType:                 "VSockLinkType",
+	NordicBLELinkType:             "NordicBLELinkType",
+	LinuxSLL2LinkType:             "LinuxSLL2LinkType",
+	USB20LinkType:                 "USB20LinkType",
+}
+
+// linkTypeNames maps each registered LinkType to its name
+// without the "LINKTYPE_" prefix.
+var linkTypeNames = map[LinkType]string{
+	0:   "NULL",
+	1:   "ETHERNET",
+	3:   "AX25",
+	6:   "IEEE802_5",
+	7:   "ARCNET_BSD",
+	8:   "SLIP",
+	9:   "PPP",
+	10:  "FDDI",
+	50:  "PPP_HDLC",
+	51:  "PPP_ETHER",
+	100: "ATM_RFC1483",
+	101: "RAW",
+	104: "C_HDLC",
+	105: "IEEE802_11",
+	107: "FRELAY",
+	108: "LOOP",
+	113: "LINUX_SLL",
+	114: "LTALK",
+	117: "PFLOG",
+	119: "IEEE802_11_PRISM",
+	122: "IP_OVER_FC",
+	123: "SUNATM",
+	127: "IEEE802_11_RADIOTAP",
+	129: "ARCNET_LINUX",
+	138: "APPLE_IP_OVER_IEEE1394",
+	139: "MTP2_WITH_PHDR",
+	140: "MTP2",
+	141: "MTP3",
+	142: "SCCP",
+	143: "DOCSIS",
+	144: "LINUX_IRDA",
+	147: "USER0",
+	148: "USER1",
+	149: "USER2",
+	150: "USER3",
+	151: "USER4",
+	152: "USER5",
+	153: "USER6",
+	154: "USER7",
+	155: "USER8",
+	156: "USER9",
+	157: "USER10",
+	158: "USER11",
+	159: "USER12",
+	160: "USER13",
+	161: "USER14",
+	162: "USER15",
+	163: "IEEE802_11_AVS",
+	165: "BACNET_MS_TP",
+	166: "PPP_PPPD",
+	169: "GPRS_LLC",
+	170: "GPF_T",
+	171: "GPF_F",
+	177: "LINUX_LAPD",
+	182: "MFR",
+	187: "BLUETOOTH_HCI_H4",
+	189: "USB_LINUX",
+	192: "PPI",
+	195: "IEEE802_15_4_WITHFCS",
+	196: "SITA",
+	197: "ERF",
+	201: "BLUETOOTH_HCI_H4_WITH_PHDR",
+	202: "AX25_KISS",
+	203: "LAPD",
+	204: "PPP_WITH_DIR",
+	205: "C_HDLC_WITH_DIR",
+	206: "FRELAY_WITH_DIR",
+	207: "LAPB_WITH_DIR",
+	209: "IPMB_LINUX",
+	210: "FLEXRAY",
+	212: "LIN",
+	215: "IEEE802_15_4_NONASK_PHY",
+	220: "USB_LINUX_MMAPPED",
+	224: "FC_2",
+	225: "FC_2_WITH_FRAME_DELIMS",
+	226: "IPNET",
+	227: "CAN_SOCKETCAN",
+	228: "IPV4",
+	229: "IPV6",
+	230: "IEEE802_15_4_NOFCS",
+	231: "DBUS",
+	235: "DVB_CI",
+	236: "MUX27010",
+	237: "STANAG_5066_D_PDU",
+	239: "NFLOG",
+	240: "NETANALYZER",
+	241: "NETANALYZER_TRANSPARENT",
+	242: "IPOIB",
+	243: "MPEG_2_TS",
+	244: "NG40",
+	245: "NFC_LLCP",
+	247: "INFINIBAND",
+	248: "SCTP",
+	249: "USBPCAP",
+	250: "RTAC_SERIAL",
+	251: "BLUETOOTH_LE_LL",
+	253: "NETLINK",
+	254: "BLUETOOTH_LINUX_MONITOR",
+	255: "BLUETOOTH_BREDR_BB",
+	256: "BLUETOOTH_LE_LL_WITH_PHDR",
+	257: "PROFIBUS_DL",
+	258: "PKTAP",
+	259: "EPON",
+	260: "IPMI_HPM_2",
+	261: "ZWAVE_R1_R2",
+	262: "ZWAVE_R3",
+	263: "WATTSTOPPER_DLM",
+	264: "ISO_14443",
+	265: "RDS",
+	266: "USB_DARWIN",
+	268: "SDLC",
+	270: "LORATAP",
+	271: "VSOCK",
+	272: "NORDIC_BLE",
+	273: "DOCSIS31_XRA31",
+	274: "ETHERNET_MPACKET",
+	275: "DISPLAYPORT_AUX",
+	276: "LINUX_SLL2",
+	278: "OPENVIZSLA",
+	279: "EBHSCR",
+	280: "VPP_DISPATCH",
+	281: "DSA_TAG_BRCM",
+	282: "DSA_TAG_BRCM_PREPEND",
+	283: "IEEE802_15_4_TAP",
+	284: "DSA_TAG_DSA",
+	285: "DSA_TAG_EDSA",
+	286: "ELEE",
+	287: "Z_WAVE_SERIAL",
+	288: "USB_2_0",
+	289: "ATSC_ALP",
+	290: "ETW",
+	292: "ZBOSS_NCP",
+	293: "USB_2_0_LOW_SPEED",
+	294: "USB_2_0_FULL_SPEED",
+	295: "USB_2_0_HIGH_SPEED",
+	296: "AUERSWALD_LOG",
+	297: "ZWAVE_TAP",
+	298: "SILABS_DEBUG_CHANNEL",
+	299: "FIRA_UCI",
+	300: "MDB",
+	301: "DECT_NR",
+}
+
+// String returns the Go identifier of the LinkType if there is a
+// constant declared for it (e.g., "EthernetLinkType"),
+// otherwise it returns "LinkType(N)" where N is its numeric value.
+// Use Name to obtain the registered name of any LinkType.
+func (t LinkType) String() string {
+	if s, ok := linkTypeGoNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("LinkType(%d)", t)
+}
+
+// Name returns the registered name of the LinkType without the
+// "LINKTYPE_" prefix (e.g., "LINUX_SLL2"), or the empty string if unknown.
+func (t LinkType) Name() string {
+	return linkTypeNames[t]
+}
+
+// ParseLinkType parses a LinkType from its registered name, with or without
+// the "LINKTYPE_" prefix (e.g., "LINUX_SLL2" or "LINKTYPE_LINUX_SLL2"),
+// its Go identifier (e.g., "LinuxSLL2LinkType"), or its decimal value.
+// Registered names are matched case-insensitively.
+func ParseLinkType(s string) (LinkType, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return LinkType(n), nil
+	}
+	name := strings.TrimPrefix(strings.ToUpper(s), "LINKTYPE_")
+	for t, n := range linkTypeNames {
+		if n == name {
+			return t, nil
+		}
+	}
+	for t, n := range linkTypeGoNames {
+		if n == s {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown link type %q", s)
+}
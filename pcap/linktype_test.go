@@ -0,0 +1,74 @@
+// Copyright 2022, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package pcap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLinkType(t *testing.T) {
+	for _, tt := range []struct {
+		in       LinkType
+		wantName string
+		wantStr  string
+	}{
+		{EthernetLinkType, "ETHERNET", "EthernetLinkType"},
+		{LinuxSLL2LinkType, "LINUX_SLL2", "LinuxSLL2LinkType"},
+		{LinkType(147), "USER0", "LinkType(147)"},
+		{LinkType(1000), "", "LinkType(1000)"},
+	} {
+		if got := tt.in.Name(); got != tt.wantName {
+			t.Errorf("LinkType(%d).Name() = %q, want %q", tt.in, got, tt.wantName)
+		}
+		if got := tt.in.String(); got != tt.wantStr {
+			t.Errorf("LinkType(%d).String() = %q, want %q", tt.in, got, tt.wantStr)
+		}
+	}
+}
+
+func TestParseLinkType(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    LinkType
+		wantErr bool
+	}{
+		{in: "ETHERNET", want: EthernetLinkType},
+		{in: "ethernet", want: EthernetLinkType},
+		{in: "LINKTYPE_LINUX_SLL2", want: LinuxSLL2LinkType},
+		{in: "linktype_linux_sll2", want: LinuxSLL2LinkType},
+		{in: "LinuxSLL2LinkType", want: LinuxSLL2LinkType},
+		{in: "linuxsll2linktype", wantErr: true},
+		{in: "147", want: 147},
+		{in: "1000", want: 1000},
+		{in: "LINKTYPE_", wantErr: true},
+		{in: "LINKTYPE_1", wantErr: true},
+		{in: "BOGUS", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "", wantErr: true},
+	} {
+		got, err := ParseLinkType(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseLinkType(%q) = (%v, %v), want (%v, error %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	// Every registered name and Go identifier round-trips.
+	for lt, name := range linkTypeNames {
+		for _, s := range []string{name, "LINKTYPE_" + name, strings.ToLower(name)} {
+			if got, err := ParseLinkType(s); got != lt || err != nil {
+				t.Errorf("ParseLinkType(%q) = (%v, %v), want (%v, nil)", s, got, err, lt)
+			}
+		}
+	}
+	for lt, name := range linkTypeGoNames {
+		if got, err := ParseLinkType(lt.String()); got != lt || err != nil {
+			t.Errorf("ParseLinkType(%q) = (%v, %v), want (%v, nil)", name, got, err, lt)
+		}
+		if lt.Name() == "" {
+			t.Errorf("LinkType(%d).Name() is empty for constant %s", lt, name)
+		}
+	}
+}
@@ -2,11 +2,13 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE.md file.
 
-// Package pcap implements reader and writer for the pcap file format.
+// Package pcap implements reader and writer for the pcap file format,
+// including both the classic libpcap format and the pcapng format.
 package pcap
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -22,27 +24,12 @@ const (
 	packetHeaderSize = 16
 
 	defaultBufSize = 64 << 10
-)
-
-// LinkType specifies the type of each Packet.Data.
-type LinkType uint32
 
-const (
-	EthernetLinkType LinkType = 1   // ethernet; IEEE 802.3
-	RawLinkType      LinkType = 101 // raw IP; either IPv4 or IPv6
+	// maxSnapLen is the largest snapshot length that libpcap uses,
+	// which bounds oversized packets when ReaderOptions.MaxPacketSize is zero.
+	maxSnapLen = 262144
 )
 
-func (t LinkType) String() string {
-	switch t {
-	case EthernetLinkType:
-		return "EthernetLinkType"
-	case RawLinkType:
-		return "RawLinkType"
-	default:
-		return fmt.Sprintf("LinkType(%d)", t)
-	}
-}
-
 // Header contains information from the pcap stream header.
 type Header struct {
 	// SnapLen is the snapshot length used for capturing each packet.
@@ -67,6 +54,10 @@ type Packet struct {
 	// Its length may be less than OrigLen if truncated and
 	// must not exceed Header.SnapLen.
 	Data []byte
+
+	// InterfaceIndex is the index of the capture interface in a pcapng stream.
+	// It is always zero for the classic pcap format.
+	InterfaceIndex int
 }
 
 // Clone returns a deep copy of Packet.
@@ -79,28 +70,96 @@ func (p Packet) Clone() Packet {
 type Writer struct {
 	header Header
 	writer io.Writer
+	order  byteOrder
+	micros bool
 
 	scratch [packetHeaderSize]byte
 
+	ng     bool          // whether to use the pcapng format
+	ifaces []ngInterface // interfaces for the pcapng format
+
 	err error
 }
 
+// byteOrder is implemented by binary.LittleEndian and binary.BigEndian.
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// WriterOptions configures the classic pcap header written by a Writer.
+// The zero value writes little-endian, nanosecond-resolution
+// version 2.4 headers.
+type WriterOptions struct {
+	// TimestampResolution is the resolution of packet timestamps,
+	// which must be either time.Microsecond or time.Nanosecond.
+	// If zero, time.Nanosecond is used.
+	TimestampResolution time.Duration
+
+	// ByteOrder is the byte order of the header and packet headers,
+	// which must be either binary.LittleEndian or binary.BigEndian.
+	// If nil, binary.LittleEndian is used.
+	ByteOrder binary.ByteOrder
+
+	// VersionMajor and VersionMinor are the format version numbers.
+	// If both are zero, version 2.4 is used.
+	VersionMajor uint16
+	VersionMinor uint16
+
+	// ZoneOffset is the thiszone field, which is the correction in seconds
+	// from the local time zone to UTC. It is usually zero.
+	ZoneOffset int32
+
+	// SigFigs is the sigfigs field, which is the accuracy of timestamps.
+	// It is usually zero.
+	SigFigs uint32
+}
+
 // NewWriter writes the pcap header and returns a Writer that
 // writes each subsequent packet after the header.
+// It is equivalent to WriterOptions{}.NewWriter.
 //
 // For performance, it is recommended that the io.Writer be buffered,
 // such as provided by bufio.Writer.
 func NewWriter(wr io.Writer, h Header) (*Writer, error) {
+	return WriterOptions{}.NewWriter(wr, h)
+}
+
+// NewWriter writes the pcap header according to the options
+// and returns a Writer that writes each subsequent packet after the header.
+func (o WriterOptions) NewWriter(wr io.Writer, h Header) (*Writer, error) {
+	w := &Writer{header: h, writer: wr, order: binary.LittleEndian}
+	magic := uint32(magicNanos)
+	switch o.TimestampResolution {
+	case 0, time.Nanosecond:
+	case time.Microsecond:
+		magic, w.micros = magicMicros, true
+	default:
+		return nil, fmt.Errorf("invalid timestamp resolution %v", o.TimestampResolution)
+	}
+	if o.ByteOrder != nil {
+		order, ok := o.ByteOrder.(byteOrder)
+		if !ok {
+			return nil, fmt.Errorf("invalid byte order %v", o.ByteOrder)
+		}
+		w.order = order
+	}
+	if o.VersionMajor == 0 && o.VersionMinor == 0 {
+		o.VersionMajor, o.VersionMinor = 2, 4
+	}
+
 	var header [globalHeaderSize]byte
-	binary.LittleEndian.PutUint32(header[0:4], magicNanos)           // magicNumber
-	binary.LittleEndian.PutUint16(header[4:6], 2)                    // versionMinor
-	binary.LittleEndian.PutUint16(header[6:8], 4)                    // versionMajor
-	binary.LittleEndian.PutUint32(header[16:20], uint32(h.SnapLen))  // snapLen
-	binary.LittleEndian.PutUint32(header[20:24], uint32(h.LinkType)) // linkType
+	w.order.PutUint32(header[0:4], magic)                 // magicNumber
+	w.order.PutUint16(header[4:6], o.VersionMajor)        // versionMajor
+	w.order.PutUint16(header[6:8], o.VersionMinor)        // versionMinor
+	w.order.PutUint32(header[8:12], uint32(o.ZoneOffset)) // thisZone
+	w.order.PutUint32(header[12:16], o.SigFigs)           // sigFigs
+	w.order.PutUint32(header[16:20], uint32(h.SnapLen))   // snapLen
+	w.order.PutUint32(header[20:24], uint32(h.LinkType))  // linkType
 	if _, err := wr.Write(header[:]); err != nil {
 		return nil, err
 	}
-	return &Writer{header: h, writer: wr}, nil
+	return w, nil
 }
 
 // WriteNext writes the next packet in the stream.
@@ -112,6 +171,12 @@ func (w *Writer) WriteNext(p Packet) error {
 	if len(p.Data) > p.OrigLen {
 		return fmt.Errorf("capture length exceeds packet length: %d > %d", len(p.Data), p.OrigLen)
 	}
+	if w.ng {
+		return w.writeNextNG(p)
+	}
+	if p.InterfaceIndex != 0 {
+		return fmt.Errorf("unknown interface index %d", p.InterfaceIndex)
+	}
 	if len(p.Data) > w.header.SnapLen {
 		return fmt.Errorf("capture length exceeds snapshot length: %d > %d", len(p.Data), w.header.SnapLen)
 	}
@@ -121,10 +186,14 @@ func (w *Writer) WriteNext(p Packet) error {
 	} else {
 		b = w.scratch[:0]
 	}
-	b = binary.LittleEndian.AppendUint32(b, uint32(p.Timestamp.Unix()))
-	b = binary.LittleEndian.AppendUint32(b, uint32(p.Timestamp.Nanosecond()))
-	b = binary.LittleEndian.AppendUint32(b, uint32(len(p.Data)))
-	b = binary.LittleEndian.AppendUint32(b, uint32(p.OrigLen))
+	subsec := p.Timestamp.Nanosecond()
+	if w.micros {
+		subsec /= 1000
+	}
+	b = w.order.AppendUint32(b, uint32(p.Timestamp.Unix()))
+	b = w.order.AppendUint32(b, uint32(subsec))
+	b = w.order.AppendUint32(b, uint32(len(p.Data)))
+	b = w.order.AppendUint32(b, uint32(p.OrigLen))
 	if _, w.err = w.writer.Write(b); w.err != nil {
 		return w.err
 	}
@@ -138,23 +207,83 @@ func (w *Writer) WriteNext(p Packet) error {
 type Reader struct {
 	Header // must not be modified
 
-	reader    io.Reader
-	bufReader *bufio.Reader
-	nanos     bool
-	swapped   bool
-	location  *time.Location
+	reader     io.Reader
+	bufReader  *bufio.Reader
+	nanos      bool
+	swapped    bool
+	location   *time.Location
+	headerOpts WriterOptions // options that reproduce the classic header
+	opts       ReaderOptions
+
+	// Fields for the pcapng format.
+	ng          bool
+	order       binary.ByteOrder
+	sectionSeen bool
+	ifaces      []ngInterface
+	names       []NameRecord
+	buf         []byte
+}
+
+// ReaderOptions configures how a Reader handles untrusted or malformed input.
+// The zero value rejects any malformed packet.
+type ReaderOptions struct {
+	// MaxPacketSize is the maximum capture length of a packet.
+	// Packets that exceed it are reported as an error.
+	// It also bounds the buffer allocated by Reader.ReadNext,
+	// even if Header.SnapLen is larger.
+	// For pcapng, it limits the size of each block,
+	// which includes the packet data and any options.
+	// If zero, there is no limit other than Header.SnapLen.
+	MaxPacketSize int
+
+	// AllowOversized specifies that packets with a capture length that
+	// exceeds the snapshot length are reported as a warning rather than
+	// an error, since some tools write such packets.
+	// Oversized packets are still limited by MaxPacketSize,
+	// or 262144 bytes if MaxPacketSize is zero.
+	AllowOversized bool
+
+	// Resync specifies that the Reader skips over corrupt data by searching
+	// for the next plausible packet header (or pcapng block) and reports
+	// the number of skipped bytes as a warning rather than an error.
+	// Recovery is best-effort and may skip over valid packets.
+	Resync bool
+
+	// Warn is called for each warning. If nil, warnings are discarded.
+	Warn func(error)
 }
 
 // NewReader parses the pcap header and returns a Reader that
 // parses each subsequent packet after the header.
+// The format is automatically detected as either classic pcap or pcapng.
+// For pcapng, the Header is populated from the first interface description.
+// It is equivalent to ReaderOptions{}.NewReader.
 //
 // The first call to Reader.ReadNext allocates a buffer
 // proportional to Header.SnapLen, which may be arbitrarily large.
 // It is the caller's responsibility to check whether the amount of memory
-// needed is reasonable.
+// needed is reasonable, or to use ReaderOptions.MaxPacketSize.
 func NewReader(rd io.Reader) (*Reader, error) {
+	return ReaderOptions{}.NewReader(rd)
+}
+
+// NewReader parses the pcap header and returns a Reader that
+// parses each subsequent packet after the header according to the options.
+func (o ReaderOptions) NewReader(rd io.Reader) (*Reader, error) {
+	if o.MaxPacketSize < 0 {
+		return nil, fmt.Errorf("invalid maximum packet size %d", o.MaxPacketSize)
+	}
 	var header [globalHeaderSize]byte
-	if _, err := io.ReadFull(rd, header[:]); err != nil {
+	if _, err := io.ReadFull(rd, header[:4]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header[:4]) == blockSHB {
+		return newNGReader(io.MultiReader(bytes.NewReader(header[:4]), rd), o)
+	}
+	if _, err := io.ReadFull(rd, header[4:]); err != nil {
 		if err == io.EOF {
 			err = io.ErrUnexpectedEOF
 		}
@@ -165,11 +294,12 @@ func NewReader(rd io.Reader) (*Reader, error) {
 		versionMajor = binary.LittleEndian.Uint16(header[4:6])
 		versionMinor = binary.LittleEndian.Uint16(header[6:8])
 		zoneOffset   = binary.LittleEndian.Uint32(header[8:12])
+		sigFigs      = binary.LittleEndian.Uint32(header[12:16])
 		snapLen      = binary.LittleEndian.Uint32(header[16:20])
 		linkType     = binary.LittleEndian.Uint32(header[20:24])
 	)
 
-	r := new(Reader)
+	r := &Reader{opts: o}
 	switch magicNumber {
 	case magicMicros:
 		r.nanos, r.swapped = false, false
@@ -186,6 +316,7 @@ func NewReader(rd io.Reader) (*Reader, error) {
 		versionMajor = bits.ReverseBytes16(versionMajor)
 		versionMinor = bits.ReverseBytes16(versionMinor)
 		zoneOffset = bits.ReverseBytes32(zoneOffset)
+		sigFigs = bits.ReverseBytes32(sigFigs)
 		snapLen = bits.ReverseBytes32(snapLen)
 		linkType = bits.ReverseBytes32(linkType)
 	}
@@ -201,17 +332,46 @@ func NewReader(rd io.Reader) (*Reader, error) {
 	r.SnapLen = int(snapLen)
 	r.LinkType = LinkType(linkType)
 	r.reader = rd
+	r.headerOpts = WriterOptions{
+		TimestampResolution: time.Microsecond,
+		ByteOrder:           binary.LittleEndian,
+		VersionMajor:        versionMajor,
+		VersionMinor:        versionMinor,
+		ZoneOffset:          int32(zoneOffset),
+		SigFigs:             sigFigs,
+	}
+	if r.nanos {
+		r.headerOpts.TimestampResolution = time.Nanosecond
+	}
+	if r.swapped {
+		r.headerOpts.ByteOrder = binary.BigEndian
+	}
 	return r, nil
 }
 
+// WriterOptions returns the options that reproduce the header of a
+// classic pcap stream, such that a Writer created with them writes a header
+// identical to the one read. For a pcapng stream, it returns the zero value.
+func (r *Reader) WriterOptions() WriterOptions {
+	return r.headerOpts
+}
+
 // ReadNext reads the next packet in the stream.
 // The contents of Packet.Data is only valid until the next ReadNext call.
 // Call Packet.Clone if a copy of the packet is needed.
 // If there are no more packets in the stream, it returns io.EOF.
 func (r *Reader) ReadNext() (Packet, error) {
+	if r.ng {
+		return r.readNextNG()
+	}
+
 	// Initialize the bufio.Reader if necessary.
 	if r.bufReader == nil {
-		bufSize := 2 * (packetHeaderSize + r.SnapLen)
+		n := r.SnapLen
+		if r.opts.MaxPacketSize > 0 && n > r.opts.MaxPacketSize {
+			n = r.opts.MaxPacketSize
+		}
+		bufSize := 2 * (packetHeaderSize + n)
 		if bufSize < defaultBufSize {
 			bufSize = defaultBufSize
 		}
@@ -219,13 +379,76 @@ func (r *Reader) ReadNext() (Packet, error) {
 	}
 
 	// Read and parse the packet header.
-	header, err := r.bufReader.Peek(packetHeaderSize)
-	if err != nil {
-		if err == io.EOF && len(header) > 0 {
-			err = io.ErrUnexpectedEOF
+	// If resyncing, skip over corrupt data one byte at a time
+	// until a plausible packet header is found.
+	var (
+		p       Packet
+		capLen  int
+		skipped int
+		cause   error
+	)
+	for {
+		header, err := r.bufReader.Peek(packetHeaderSize)
+		if err != nil {
+			if err == io.EOF && (len(header) > 0 || skipped > 0) {
+				err = io.ErrUnexpectedEOF
+			}
+			if skipped > 0 {
+				r.warn(fmt.Errorf("skipped %d bytes after corrupt data: %v", skipped, cause))
+			}
+			return Packet{}, err
+		}
+		p, capLen, err = r.parseHeader(header)
+		if err == nil {
+			break
+		}
+		if !r.opts.Resync {
+			return Packet{}, err
 		}
-		return Packet{}, err
+		if skipped == 0 {
+			cause = err
+		}
+		r.bufReader.Discard(1)
+		skipped++
+	}
+	if skipped > 0 {
+		r.warn(fmt.Errorf("skipped %d bytes after corrupt data: %v", skipped, cause))
+	}
+	if capLen > r.SnapLen {
+		r.warn(fmt.Errorf("capture length exceeds snapshot length: %d > %d", capLen, r.SnapLen))
 	}
+
+	// Read the packet data.
+	// Oversized packets may not fit in the buffer and are read separately.
+	if n := packetHeaderSize + capLen; n <= r.bufReader.Size() {
+		b, err := r.bufReader.Peek(n)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return Packet{}, err
+		}
+		r.bufReader.Discard(n)
+		p.Data = b[packetHeaderSize:]
+	} else {
+		r.bufReader.Discard(packetHeaderSize)
+		if cap(r.buf) < capLen {
+			r.buf = make([]byte, capLen)
+		}
+		if _, err := io.ReadFull(r.bufReader, r.buf[:capLen]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return Packet{}, err
+		}
+		p.Data = r.buf[:capLen]
+	}
+	return p, nil
+}
+
+// parseHeader parses and validates a classic packet header,
+// returning the packet without its data and the capture length.
+func (r *Reader) parseHeader(header []byte) (Packet, int, error) {
 	var (
 		timeSec = binary.LittleEndian.Uint32(header[0:4])
 		timeSub = binary.LittleEndian.Uint32(header[4:8])
@@ -238,31 +461,56 @@ func (r *Reader) ReadNext() (Packet, error) {
 		capLen = bits.ReverseBytes32(capLen)
 		origLen = bits.ReverseBytes32(origLen)
 	}
+	if capLen > origLen {
+		return Packet{}, 0, headerError{"capture length exceeds packet length: %d > %d", uint64(capLen), uint64(origLen)}
+	}
+	if n := r.opts.MaxPacketSize; n > 0 && uint64(capLen) > uint64(n) {
+		return Packet{}, 0, headerError{"capture length exceeds maximum: %d > %d", uint64(capLen), uint64(n)}
+	}
+	if capLen > uint32(r.SnapLen) {
+		if !r.opts.AllowOversized || uint64(capLen) > r.maxOversized() {
+			return Packet{}, 0, headerError{"capture length exceeds snapshot length: %d > %d", uint64(capLen), uint64(r.SnapLen)}
+		}
+	}
 	var t time.Time
 	if r.nanos {
+		if r.opts.Resync && timeSub >= 1e9 {
+			return Packet{}, 0, headerError{"invalid timestamp nanoseconds: %d >= %d", uint64(timeSub), 1e9}
+		}
 		t = time.Unix(int64(timeSec), int64(timeSub))
 	} else {
+		if r.opts.Resync && timeSub >= 1e6 {
+			return Packet{}, 0, headerError{"invalid timestamp microseconds: %d >= %d", uint64(timeSub), 1e6}
+		}
 		t = time.Unix(int64(timeSec), 1000*int64(timeSub))
 	}
 	if r.location != nil {
 		t = t.In(r.location)
 	}
-	if capLen > origLen {
-		return Packet{}, fmt.Errorf("capture length exceeds packet length: %d > %d", capLen, origLen)
-	}
-	if capLen > uint32(r.SnapLen) {
-		return Packet{}, fmt.Errorf("capture length exceeds snapshot length: %d > %d", capLen, r.SnapLen)
-	}
+	return Packet{Timestamp: t, OrigLen: int(origLen)}, int(capLen), nil
+}
 
-	// Read the packet data.
-	b, err := r.bufReader.Peek(packetHeaderSize + int(capLen))
-	if err != nil {
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
-		}
-		return Packet{}, err
+// headerError is an invalid packet header error.
+// It is formatted lazily since many candidate headers may be rejected
+// while resyncing after corrupt data.
+type headerError struct {
+	format string
+	x, y   uint64
+}
+
+func (e headerError) Error() string { return fmt.Sprintf(e.format, e.x, e.y) }
+
+// maxOversized reports the maximum capture length of an oversized packet.
+func (r *Reader) maxOversized() uint64 {
+	if r.opts.MaxPacketSize > 0 {
+		return uint64(r.opts.MaxPacketSize)
 	}
+	return maxSnapLen
+}
 
-	r.bufReader.Discard(packetHeaderSize + int(capLen))
-	return Packet{t, int(origLen), b[packetHeaderSize:]}, nil
+// warn reports a warning to ReaderOptions.Warn, if any.
+func (r *Reader) warn(err error) {
+	if r.opts.Warn != nil {
+		r.opts.Warn(err)
+	}
 }
@@ -0,0 +1,276 @@
+// Copyright 2022, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// testPackets returns a classic pcap stream and a pcapng stream
+// containing the same packets.
+func testPackets(t testing.TB) (classic, ng []byte) {
+	h := Header{SnapLen: 64, LinkType: EthernetLinkType}
+	var bb1, bb2 bytes.Buffer
+	w1, err := WriterOptions{TimestampResolution: time.Microsecond, ByteOrder: binary.BigEndian}.NewWriter(&bb1, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2, err := NewNGWriter(&bb2, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		p := Packet{
+			Timestamp: time.Unix(1600000000+int64(i), int64(i)*1000),
+			Data:      bytes.Repeat([]byte{byte(i)}, 8*i),
+			OrigLen:   8*i + i,
+		}
+		if err := w1.WriteNext(p); err != nil {
+			t.Fatal(err)
+		}
+		if err := w2.WriteNext(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bb1.Bytes(), bb2.Bytes()
+}
+
+func TestWriterOptions(t *testing.T) {
+	h := Header{SnapLen: 64, LinkType: EthernetLinkType}
+	packets := []Packet{
+		{Timestamp: time.Unix(1600000000, 123456789), OrigLen: 10, Data: []byte("hello")},
+		{Timestamp: time.Unix(1600000001, 0), OrigLen: 4, Data: []byte("abcd")},
+	}
+	for _, tt := range []struct {
+		name      string
+		opts      WriterOptions
+		wantMagic []byte
+		wantOpts  WriterOptions
+	}{{
+		name:      "Default",
+		wantMagic: []byte{0x4d, 0x3c, 0xb2, 0xa1},
+		wantOpts:  WriterOptions{TimestampResolution: time.Nanosecond, ByteOrder: binary.LittleEndian, VersionMajor: 2, VersionMinor: 4},
+	}, {
+		name:      "Microsecond",
+		opts:      WriterOptions{TimestampResolution: time.Microsecond},
+		wantMagic: []byte{0xd4, 0xc3, 0xb2, 0xa1},
+		wantOpts:  WriterOptions{TimestampResolution: time.Microsecond, ByteOrder: binary.LittleEndian, VersionMajor: 2, VersionMinor: 4},
+	}, {
+		name:      "BigEndian",
+		opts:      WriterOptions{ByteOrder: binary.BigEndian},
+		wantMagic: []byte{0xa1, 0xb2, 0x3c, 0x4d},
+		wantOpts:  WriterOptions{TimestampResolution: time.Nanosecond, ByteOrder: binary.BigEndian, VersionMajor: 2, VersionMinor: 4},
+	}, {
+		name:      "BigEndianMicrosecond",
+		opts:      WriterOptions{TimestampResolution: time.Microsecond, ByteOrder: binary.BigEndian},
+		wantMagic: []byte{0xa1, 0xb2, 0xc3, 0xd4},
+		wantOpts:  WriterOptions{TimestampResolution: time.Microsecond, ByteOrder: binary.BigEndian, VersionMajor: 2, VersionMinor: 4},
+	}, {
+		name:      "HeaderFields",
+		opts:      WriterOptions{VersionMajor: 2, VersionMinor: 3, ZoneOffset: -3600, SigFigs: 6},
+		wantMagic: []byte{0x4d, 0x3c, 0xb2, 0xa1},
+		wantOpts:  WriterOptions{TimestampResolution: time.Nanosecond, ByteOrder: binary.LittleEndian, VersionMajor: 2, VersionMinor: 3, ZoneOffset: -3600, SigFigs: 6},
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			write := func(o WriterOptions, ps []Packet) []byte {
+				var bb bytes.Buffer
+				w, err := o.NewWriter(&bb, h)
+				if err != nil {
+					t.Fatalf("NewWriter error: %v", err)
+				}
+				for _, p := range ps {
+					if err := w.WriteNext(p); err != nil {
+						t.Fatalf("WriteNext error: %v", err)
+					}
+				}
+				return bb.Bytes()
+			}
+			in := write(tt.opts, packets)
+			if !bytes.Equal(in[:4], tt.wantMagic) {
+				t.Errorf("magic number = %x, want %x", in[:4], tt.wantMagic)
+			}
+
+			r, err := NewReader(bytes.NewReader(in))
+			if err != nil {
+				t.Fatalf("NewReader error: %v", err)
+			}
+			if r.Header != h {
+				t.Errorf("Header = %+v, want %+v", r.Header, h)
+			}
+			if got := r.WriterOptions(); got != tt.wantOpts {
+				t.Errorf("WriterOptions() = %+v, want %+v", got, tt.wantOpts)
+			}
+			var got []Packet
+			for {
+				p, err := r.ReadNext()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("ReadNext error: %v", err)
+				}
+				want := packets[len(got)]
+				if ts := want.Timestamp.Truncate(tt.wantOpts.TimestampResolution); !p.Timestamp.Equal(ts) {
+					t.Errorf("packet %d, Timestamp = %v, want %v", len(got), p.Timestamp, ts)
+				}
+				if p.OrigLen != want.OrigLen || !bytes.Equal(p.Data, want.Data) {
+					t.Errorf("packet %d = %+v, want %+v", len(got), p, want)
+				}
+				got = append(got, p.Clone())
+			}
+
+			// Writing the packets with the options read reproduces the input.
+			if out := write(r.WriterOptions(), got); !bytes.Equal(out, in) {
+				t.Errorf("round trip mismatch:\ngot  %x\nwant %x", out, in)
+			}
+		})
+	}
+
+	for _, o := range []WriterOptions{
+		{TimestampResolution: time.Millisecond},
+		{ByteOrder: struct{ binary.ByteOrder }{binary.BigEndian}},
+	} {
+		if _, err := o.NewWriter(io.Discard, h); err == nil {
+			t.Errorf("WriterOptions(%+v).NewWriter succeeded, want error", o)
+		}
+	}
+}
+
+func TestReaderResync(t *testing.T) {
+	classic, ng := testPackets(t)
+
+	// Locate the length field of the fourth enhanced packet block.
+	var ngCorrupt int
+	for off, n := 0, 0; n < 4; off += int(binary.LittleEndian.Uint32(ng[off+4:])) {
+		if binary.LittleEndian.Uint32(ng[off:]) == blockEPB {
+			ngCorrupt = off + 4
+			n++
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		in      []byte
+		corrupt int // offset of data to corrupt
+	}{
+		// Corrupt the capture length of the fourth packet.
+		{"Classic", classic, globalHeaderSize + 3*packetHeaderSize + 24 + 8},
+		{"PcapNG", ng, ngCorrupt},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			in := append([]byte(nil), tt.in...)
+			binary.BigEndian.PutUint32(in[tt.corrupt:], 0xdeadbeef)
+
+			var warnings int
+			r, err := ReaderOptions{Resync: true, Warn: func(error) { warnings++ }}.NewReader(bytes.NewReader(in))
+			if err != nil {
+				t.Fatalf("NewReader error: %v", err)
+			}
+			var n int
+			for {
+				p, err := r.ReadNext()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("ReadNext error: %v", err)
+				}
+				if len(p.Data) > 0 && p.Data[0] == 7 {
+					n++ // Last packet must be recovered
+				}
+			}
+			if n != 1 || warnings == 0 {
+				t.Errorf("recovered last packet %d times with %d warnings, want 1 time with some warnings", n, warnings)
+			}
+		})
+	}
+}
+
+func TestReaderOversized(t *testing.T) {
+	var bb bytes.Buffer
+	w, err := NewWriter(&bb, Header{SnapLen: 1 << 20, LinkType: EthernetLinkType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteNext(Packet{Data: make([]byte, 1000), OrigLen: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	in := bb.Bytes()
+	binary.LittleEndian.PutUint32(in[16:20], 100) // shrink snapshot length
+
+	for _, tt := range []struct {
+		name     string
+		opts     ReaderOptions
+		wantErr  bool
+		wantWarn bool
+	}{
+		{"Default", ReaderOptions{}, true, false},
+		{"AllowOversized", ReaderOptions{AllowOversized: true}, false, true},
+		{"AllowOversizedLimited", ReaderOptions{AllowOversized: true, MaxPacketSize: 500}, true, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var warned bool
+			tt.opts.Warn = func(error) { warned = true }
+			r, err := tt.opts.NewReader(bytes.NewReader(in))
+			if err != nil {
+				t.Fatalf("NewReader error: %v", err)
+			}
+			p, err := r.ReadNext()
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Errorf("ReadNext error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && len(p.Data) != 1000 {
+				t.Errorf("len(Packet.Data) = %d, want 1000", len(p.Data))
+			}
+			if warned != tt.wantWarn {
+				t.Errorf("warned = %v, want %v", warned, tt.wantWarn)
+			}
+		})
+	}
+}
+
+func FuzzReader(f *testing.F) {
+	classic, ng := testPackets(f)
+	f.Add(classic)
+	f.Add(ng)
+
+	const maxSize = 1 << 10
+	f.Fuzz(func(t *testing.T, in []byte) {
+		for _, opts := range []ReaderOptions{
+			{MaxPacketSize: maxSize},
+			{MaxPacketSize: maxSize, AllowOversized: true, Resync: true},
+		} {
+			r, err := opts.NewReader(bytes.NewReader(in))
+			if err != nil {
+				continue
+			}
+			// Every call either consumes input or fails,
+			// so the number of packets is bounded by the input size.
+			for i := 0; ; i++ {
+				if i > len(in) {
+					t.Fatalf("ReadNext did not terminate")
+				}
+				p, err := r.ReadNext()
+				if err != nil {
+					if err != io.EOF && errors.Is(err, io.EOF) {
+						t.Fatalf("ReadNext error wraps io.EOF: %v", err)
+					}
+					break
+				}
+				if len(p.Data) > maxSize {
+					t.Fatalf("len(Packet.Data) = %d, want <= %d", len(p.Data), maxSize)
+				}
+				if len(p.Data) > p.OrigLen {
+					t.Fatalf("len(Packet.Data) = %d, want <= %d", len(p.Data), p.OrigLen)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,729 @@
+// Copyright 2022, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package pcap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"net/netip"
+	"time"
+)
+
+// Block types and constants for the pcapng format.
+const (
+	blockSHB = 0x0a0d0d0a // Section Header Block
+	blockIDB = 0x00000001 // Interface Description Block
+	blockSPB = 0x00000003 // Simple Packet Block
+	blockNRB = 0x00000004 // Name Resolution Block
+	blockISB = 0x00000005 // Interface Statistics Block
+	blockEPB = 0x00000006 // Enhanced Packet Block
+
+	byteOrderMagic = 0x1a2b3c4d
+
+	optEndOfOpt     = 0
+	optIfName       = 2
+	optIfDesc       = 3
+	optIfTSResol    = 9
+	optIfTSOffset   = 14
+	optISBStartTime = 2
+	optISBEndTime   = 3
+	optISBIfRecv    = 4
+	optISBIfDrop    = 5
+
+	nrbRecordEnd  = 0
+	nrbRecordIPv4 = 1
+	nrbRecordIPv6 = 2
+
+	// maxBlockSize is the maximum size of a pcapng block that is read.
+	maxBlockSize = 64 << 20
+)
+
+// Interface describes a capture interface in a pcapng stream.
+type Interface struct {
+	// LinkType specifies the type of each Packet.Data captured on the interface.
+	LinkType LinkType
+
+	// SnapLen is the snapshot length used for capturing each packet,
+	// where zero means that there is no limit.
+	SnapLen int
+
+	// Name and Description are the name and description of the interface.
+	Name        string
+	Description string
+
+	// TimestampResolution is the resolution of packet timestamps,
+	// which must be a power of ten between a nanosecond and a second.
+	// If zero, the Reader reports the pcapng default of a microsecond,
+	// while the Writer uses a nanosecond.
+	// The Reader reports resolutions finer than a nanosecond as a nanosecond.
+	TimestampResolution time.Duration
+
+	// TimestampOffset is an offset added to all packet timestamps.
+	TimestampOffset time.Duration
+
+	// Stats is the last reported statistics for the interface, if any.
+	Stats *InterfaceStats
+}
+
+// InterfaceStats contains capture statistics for an Interface.
+type InterfaceStats struct {
+	// Timestamp is the time that the statistics were taken.
+	Timestamp time.Time
+
+	// StartTime and EndTime are the times that the capture started and ended.
+	StartTime time.Time
+	EndTime   time.Time
+
+	// Received is the number of packets received by the interface.
+	Received uint64
+
+	// Dropped is the number of packets dropped by the interface.
+	Dropped uint64
+}
+
+// NameRecord associates an address with the names that resolve to it.
+type NameRecord struct {
+	Addr  netip.Addr
+	Names []string
+}
+
+// ngInterface is an Interface with parsed timestamp parameters.
+type ngInterface struct {
+	Interface
+	units  uint64 // timestamp units per second
+	offset int64  // timestamp offset in seconds
+}
+
+// timestamp converts a pcapng timestamp into a time.Time.
+func (ifc *ngInterface) timestamp(ts uint64) time.Time {
+	sec, frac := ts/ifc.units, ts%ifc.units
+	hi, lo := bits.Mul64(frac, 1e9)
+	nsec, _ := bits.Div64(hi, lo, ifc.units)
+	return time.Unix(int64(sec)+ifc.offset, int64(nsec))
+}
+
+// parseTSResol parses the value of the if_tsresol option
+// as the number of units per second.
+func parseTSResol(v byte) (uint64, error) {
+	exp := uint(v & 0x7f)
+	if v&0x80 != 0 {
+		if exp > 63 {
+			return 0, fmt.Errorf("unsupported timestamp resolution 2^-%d", exp)
+		}
+		return 1 << exp, nil
+	}
+	if exp > 19 {
+		return 0, fmt.Errorf("unsupported timestamp resolution 10^-%d", exp)
+	}
+	units := uint64(1)
+	for i := uint(0); i < exp; i++ {
+		units *= 10
+	}
+	return units, nil
+}
+
+// newNGReader parses the pcapng section header and all blocks up to the
+// first Interface Description Block, which is used to populate the Header.
+func newNGReader(rd io.Reader, o ReaderOptions) (*Reader, error) {
+	r := &Reader{ng: true, order: binary.LittleEndian, opts: o}
+	r.bufReader = bufio.NewReaderSize(rd, defaultBufSize)
+	for len(r.ifaces) == 0 {
+		switch _, err := r.readBlock(); {
+		case err == io.EOF && r.sectionSeen:
+			return r, nil // Capture without any interfaces
+		case err == io.EOF:
+			return nil, io.ErrUnexpectedEOF
+		case err != nil:
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// readBlock reads and processes the next pcapng block,
+// returning the packet if it is a packet block.
+func (r *Reader) readBlock() (*Packet, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(r.bufReader, hdr[:8]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	typ := r.order.Uint32(hdr[0:4])
+	if typ == blockSHB {
+		// The byte order is determined by the byte-order magic.
+		if _, err := io.ReadFull(r.bufReader, hdr[8:12]); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		switch binary.LittleEndian.Uint32(hdr[8:12]) {
+		case byteOrderMagic:
+			r.order = binary.LittleEndian
+		case bits.ReverseBytes32(byteOrderMagic):
+			r.order = binary.BigEndian
+		default:
+			return nil, fmt.Errorf("invalid byte-order magic 0x%08x", binary.LittleEndian.Uint32(hdr[8:12]))
+		}
+	} else if !r.sectionSeen {
+		return nil, errors.New("missing section header block")
+	}
+	blockLen := r.order.Uint32(hdr[4:8])
+	if blockLen < 12 || blockLen%4 != 0 || (typ == blockSHB && blockLen < 28) {
+		return nil, fmt.Errorf("invalid block length %d", blockLen)
+	}
+	if limit := r.maxBlockLen(); blockLen > limit {
+		return nil, fmt.Errorf("block length exceeds maximum: %d > %d", blockLen, limit)
+	}
+
+	// Read the block body and trailing block length.
+	n := int(blockLen) - 8
+	if typ == blockSHB {
+		n -= 4
+	}
+	if cap(r.buf) < n {
+		r.buf = make([]byte, n)
+	}
+	b := r.buf[:n]
+	if _, err := io.ReadFull(r.bufReader, b); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if trailer := r.order.Uint32(b[len(b)-4:]); trailer != blockLen {
+		return nil, fmt.Errorf("mismatching block length %d != %d", trailer, blockLen)
+	}
+	b = b[:len(b)-4]
+
+	switch typ {
+	case blockSHB:
+		return nil, r.parseSHB(b)
+	case blockIDB:
+		return nil, r.parseIDB(b)
+	case blockEPB:
+		return r.parseEPB(b)
+	case blockSPB:
+		return r.parseSPB(b)
+	case blockNRB:
+		return nil, r.parseNRB(b)
+	case blockISB:
+		return nil, r.parseISB(b)
+	default:
+		return nil, nil // Ignore unknown blocks
+	}
+}
+
+// maxBlockLen reports the maximum length of a block that is read.
+func (r *Reader) maxBlockLen() uint32 {
+	if n := r.opts.MaxPacketSize; n > 0 && n < maxBlockSize {
+		return uint32(n)
+	}
+	return maxBlockSize
+}
+
+// resync skips over corrupt data one byte at a time until the start of
+// a plausible block is found, and reports the cause as a warning.
+// It returns io.EOF if the corrupt block was the last in the stream.
+func (r *Reader) resync(cause error) error {
+	var skipped int
+	for !r.isBlockStart() {
+		if _, err := r.bufReader.Discard(1); err != nil {
+			if skipped == 0 {
+				r.warn(cause)
+				return io.EOF
+			}
+			r.warn(fmt.Errorf("skipped %d bytes after corrupt data: %v", skipped, cause))
+			return io.ErrUnexpectedEOF
+		}
+		skipped++
+	}
+	r.warn(fmt.Errorf("skipped %d bytes after corrupt data: %v", skipped, cause))
+	return nil
+}
+
+// isBlockStart reports whether the buffered data starts with
+// a known block type with a valid block length.
+// If the entire block is buffered, the trailing block length is also checked.
+func (r *Reader) isBlockStart() bool {
+	hdr, err := r.bufReader.Peek(12)
+	if err != nil {
+		return false
+	}
+	order := r.order
+	typ := order.Uint32(hdr[0:4])
+	switch typ {
+	case blockSHB:
+		switch binary.LittleEndian.Uint32(hdr[8:12]) {
+		case byteOrderMagic:
+			order = binary.LittleEndian
+		case bits.ReverseBytes32(byteOrderMagic):
+			order = binary.BigEndian
+		default:
+			return false
+		}
+	case blockIDB, blockEPB, blockSPB, blockNRB, blockISB:
+	default:
+		return false
+	}
+	blockLen := order.Uint32(hdr[4:8])
+	if blockLen < 12 || blockLen%4 != 0 || blockLen > r.maxBlockLen() {
+		return false
+	}
+	if int(blockLen) <= r.bufReader.Size() {
+		b, err := r.bufReader.Peek(int(blockLen))
+		if err != nil || order.Uint32(b[len(b)-4:]) != blockLen {
+			return false
+		}
+	}
+	return true
+}
+
+// parseOptions calls f for each option in b.
+func (r *Reader) parseOptions(b []byte, f func(code uint16, v []byte) error) error {
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return errors.New("truncated option")
+		}
+		code, n := r.order.Uint16(b[0:2]), int(r.order.Uint16(b[2:4]))
+		if code == optEndOfOpt {
+			return nil
+		}
+		padded := 4 + (n+3)&^3
+		if len(b) < padded {
+			return errors.New("truncated option")
+		}
+		if err := f(code, b[4:4+n]); err != nil {
+			return err
+		}
+		b = b[padded:]
+	}
+	return nil
+}
+
+func (r *Reader) parseSHB(b []byte) error {
+	if len(b) < 12 {
+		return errors.New("truncated section header block")
+	}
+	if major := r.order.Uint16(b[0:2]); major != 1 {
+		return fmt.Errorf("unsupported version %d.%d", major, r.order.Uint16(b[2:4]))
+	}
+	r.sectionSeen = true
+	r.ifaces = r.ifaces[:0] // Interface indexes are local to each section
+	return nil
+}
+
+func (r *Reader) parseIDB(b []byte) error {
+	if len(b) < 8 {
+		return errors.New("truncated interface description block")
+	}
+	ifc := ngInterface{units: 1e6}
+	ifc.LinkType = LinkType(r.order.Uint16(b[0:2]))
+	ifc.SnapLen = int(r.order.Uint32(b[4:8]))
+	if ifc.SnapLen < 0 {
+		return fmt.Errorf("snapshot length overflows 32-bit signed integer")
+	}
+	err := r.parseOptions(b[8:], func(code uint16, v []byte) (err error) {
+		switch code {
+		case optIfName:
+			ifc.Name = string(v)
+		case optIfDesc:
+			ifc.Description = string(v)
+		case optIfTSResol:
+			if len(v) != 1 {
+				return errors.New("invalid if_tsresol option")
+			}
+			ifc.units, err = parseTSResol(v[0])
+		case optIfTSOffset:
+			if len(v) != 8 {
+				return errors.New("invalid if_tsoffset option")
+			}
+			ifc.offset = int64(r.order.Uint64(v))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	ifc.TimestampResolution = time.Nanosecond
+	if ifc.units < 1e9 {
+		ifc.TimestampResolution = time.Second / time.Duration(ifc.units)
+	}
+	ifc.TimestampOffset = time.Duration(ifc.offset) * time.Second
+	r.ifaces = append(r.ifaces, ifc)
+	if len(r.ifaces) == 1 && r.SnapLen == 0 && r.LinkType == 0 {
+		r.Header = Header{SnapLen: ifc.SnapLen, LinkType: ifc.LinkType}
+	}
+	return nil
+}
+
+func (r *Reader) iface(idx uint32) (*ngInterface, error) {
+	if uint64(idx) >= uint64(len(r.ifaces)) {
+		return nil, fmt.Errorf("unknown interface index %d", idx)
+	}
+	return &r.ifaces[idx], nil
+}
+
+func (r *Reader) parseEPB(b []byte) (*Packet, error) {
+	if len(b) < 20 {
+		return nil, errors.New("truncated enhanced packet block")
+	}
+	ifc, err := r.iface(r.order.Uint32(b[0:4]))
+	if err != nil {
+		return nil, err
+	}
+	ts := uint64(r.order.Uint32(b[4:8]))<<32 | uint64(r.order.Uint32(b[8:12]))
+	capLen, origLen := r.order.Uint32(b[12:16]), r.order.Uint32(b[16:20])
+	if uint64(capLen) > uint64(len(b)-20) {
+		return nil, errors.New("truncated enhanced packet block")
+	}
+	if capLen > origLen {
+		return nil, fmt.Errorf("capture length exceeds packet length: %d > %d", capLen, origLen)
+	}
+	if ifc.SnapLen > 0 && capLen > uint32(ifc.SnapLen) {
+		err := fmt.Errorf("capture length exceeds snapshot length: %d > %d", capLen, ifc.SnapLen)
+		if !r.opts.AllowOversized || uint64(capLen) > r.maxOversized() {
+			return nil, err
+		}
+		r.warn(err)
+	}
+	p := &Packet{
+		Timestamp:      ifc.timestamp(ts),
+		OrigLen:        int(origLen),
+		Data:           b[20 : 20+capLen],
+		InterfaceIndex: int(r.order.Uint32(b[0:4])),
+	}
+	return p, nil
+}
+
+func (r *Reader) parseSPB(b []byte) (*Packet, error) {
+	if len(b) < 4 {
+		return nil, errors.New("truncated simple packet block")
+	}
+	ifc, err := r.iface(0)
+	if err != nil {
+		return nil, err
+	}
+	origLen := r.order.Uint32(b[0:4])
+	capLen := uint64(origLen)
+	if ifc.SnapLen > 0 && capLen > uint64(ifc.SnapLen) {
+		capLen = uint64(ifc.SnapLen)
+	}
+	if capLen > uint64(len(b)-4) {
+		return nil, errors.New("truncated simple packet block")
+	}
+	return &Packet{OrigLen: int(origLen), Data: b[4 : 4+capLen]}, nil
+}
+
+func (r *Reader) parseNRB(b []byte) error {
+	for {
+		if len(b) < 4 {
+			return errors.New("truncated name resolution block")
+		}
+		typ, n := r.order.Uint16(b[0:2]), int(r.order.Uint16(b[2:4]))
+		padded := 4 + (n+3)&^3
+		if len(b) < padded {
+			return errors.New("truncated name resolution block")
+		}
+		v := b[4 : 4+n]
+		b = b[padded:]
+
+		var addrLen int
+		switch typ {
+		case nrbRecordEnd:
+			return nil // Ignore any options
+		case nrbRecordIPv4:
+			addrLen = 4
+		case nrbRecordIPv6:
+			addrLen = 16
+		default:
+			continue // Ignore unknown records
+		}
+		if len(v) < addrLen {
+			return errors.New("truncated name resolution record")
+		}
+		addr, _ := netip.AddrFromSlice(v[:addrLen])
+		rec := NameRecord{Addr: addr}
+		if names := bytes.TrimRight(v[addrLen:], "\x00"); len(names) > 0 {
+			for _, name := range bytes.Split(names, []byte{0}) {
+				rec.Names = append(rec.Names, string(name))
+			}
+		}
+		r.names = append(r.names, rec)
+	}
+}
+
+func (r *Reader) parseISB(b []byte) error {
+	if len(b) < 12 {
+		return errors.New("truncated interface statistics block")
+	}
+	ifc, err := r.iface(r.order.Uint32(b[0:4]))
+	if err != nil {
+		return err
+	}
+	ts := func(b []byte) time.Time {
+		return ifc.timestamp(uint64(r.order.Uint32(b[0:4]))<<32 | uint64(r.order.Uint32(b[4:8])))
+	}
+	stats := &InterfaceStats{Timestamp: ts(b[4:12])}
+	err = r.parseOptions(b[12:], func(code uint16, v []byte) error {
+		if len(v) != 8 {
+			return nil // All known options are 8 bytes
+		}
+		switch code {
+		case optISBStartTime:
+			stats.StartTime = ts(v)
+		case optISBEndTime:
+			stats.EndTime = ts(v)
+		case optISBIfRecv:
+			stats.Received = r.order.Uint64(v)
+		case optISBIfDrop:
+			stats.Dropped = r.order.Uint64(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	ifc.Stats = stats
+	return nil
+}
+
+// readNextNG reads the next packet in a pcapng stream.
+func (r *Reader) readNextNG() (Packet, error) {
+	for {
+		p, err := r.readBlock()
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF && r.opts.Resync {
+			if err = r.resync(err); err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			return Packet{}, err
+		}
+		if p != nil {
+			return *p, nil
+		}
+	}
+}
+
+// Interfaces returns the interfaces described in the current section of
+// a pcapng stream, which is indexed by Packet.InterfaceIndex.
+// For a classic pcap stream, it returns a single interface for the Header.
+func (r *Reader) Interfaces() []Interface {
+	if !r.ng {
+		return []Interface{{LinkType: r.LinkType, SnapLen: r.SnapLen}}
+	}
+	var ifcs []Interface
+	for _, ifc := range r.ifaces {
+		ifcs = append(ifcs, ifc.Interface)
+	}
+	return ifcs
+}
+
+// NameRecords returns all name resolution records read so far
+// from a pcapng stream.
+func (r *Reader) NameRecords() []NameRecord {
+	return append([]NameRecord(nil), r.names...)
+}
+
+// NewNGWriter writes a pcapng section header and an interface description
+// for the Header, and returns a Writer that writes each subsequent packet
+// as an enhanced packet block. Packet timestamps use nanosecond resolution.
+// Additional interfaces may be added with Writer.AddInterface.
+//
+// For performance, it is recommended that the io.Writer be buffered,
+// such as provided by bufio.Writer.
+func NewNGWriter(wr io.Writer, h Header) (*Writer, error) {
+	w := &Writer{header: h, writer: wr, ng: true}
+	b := appendBlockHeader(nil, blockSHB)
+	b = binary.LittleEndian.AppendUint32(b, byteOrderMagic)
+	b = binary.LittleEndian.AppendUint16(b, 1)              // versionMajor
+	b = binary.LittleEndian.AppendUint16(b, 0)              // versionMinor
+	b = binary.LittleEndian.AppendUint64(b, math.MaxUint64) // sectionLength
+	b = appendBlockTrailer(b)
+	if _, err := wr.Write(b); err != nil {
+		return nil, err
+	}
+	if _, err := w.AddInterface(Interface{LinkType: h.LinkType, SnapLen: h.SnapLen}); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// AddInterface writes an interface description block to a pcapng stream
+// and returns the interface index for use in Packet.InterfaceIndex.
+func (w *Writer) AddInterface(ifc Interface) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if !w.ng {
+		return 0, errors.New("multiple interfaces require the pcapng format")
+	}
+	if ifc.SnapLen < 0 || ifc.SnapLen > math.MaxUint32 {
+		return 0, fmt.Errorf("invalid snapshot length %d", ifc.SnapLen)
+	}
+	res := ifc.TimestampResolution
+	if res == 0 {
+		res = time.Nanosecond
+	}
+	var exp byte
+	for d := res; d < time.Second; d *= 10 {
+		exp++
+	}
+	units, _ := parseTSResol(exp)
+	if time.Second/time.Duration(units) != res {
+		return 0, fmt.Errorf("invalid timestamp resolution %v", ifc.TimestampResolution)
+	}
+
+	b := appendBlockHeader(nil, blockIDB)
+	b = binary.LittleEndian.AppendUint16(b, uint16(ifc.LinkType))
+	b = binary.LittleEndian.AppendUint16(b, 0) // reserved
+	b = binary.LittleEndian.AppendUint32(b, uint32(ifc.SnapLen))
+	b = appendOption(b, optIfName, []byte(ifc.Name))
+	b = appendOption(b, optIfDesc, []byte(ifc.Description))
+	b = appendOption(b, optIfTSResol, []byte{exp})
+	if off := int64(ifc.TimestampOffset / time.Second); off != 0 {
+		b = appendOption(b, optIfTSOffset, binary.LittleEndian.AppendUint64(nil, uint64(off)))
+	}
+	b = appendOption(b, optEndOfOpt, nil)
+	b = appendBlockTrailer(b)
+	if _, w.err = w.writer.Write(b); w.err != nil {
+		return 0, w.err
+	}
+	w.ifaces = append(w.ifaces, ngInterface{Interface: ifc, units: units, offset: int64(ifc.TimestampOffset / time.Second)})
+	return len(w.ifaces) - 1, nil
+}
+
+// WriteNameRecords writes a name resolution block to a pcapng stream.
+// Each NameRecord must have a valid IPv4 or IPv6 address.
+func (w *Writer) WriteNameRecords(recs []NameRecord) error {
+	if w.err != nil {
+		return w.err
+	}
+	if !w.ng {
+		return errors.New("name resolution requires the pcapng format")
+	}
+	b := appendBlockHeader(nil, blockNRB)
+	for _, rec := range recs {
+		if !rec.Addr.IsValid() {
+			return errors.New("invalid name resolution record address")
+		}
+		typ := uint16(nrbRecordIPv4)
+		if !rec.Addr.Is4() {
+			typ = nrbRecordIPv6
+		}
+		v := rec.Addr.AsSlice()
+		for _, name := range rec.Names {
+			v = append(append(v, name...), 0)
+		}
+		if len(v) > math.MaxUint16 {
+			return errors.New("name resolution record too large")
+		}
+		b = appendOption(b, typ, v)
+	}
+	b = appendOption(b, nrbRecordEnd, nil)
+	b = appendBlockTrailer(b)
+	_, w.err = w.writer.Write(b)
+	return w.err
+}
+
+// WriteInterfaceStats writes an interface statistics block to a pcapng stream.
+func (w *Writer) WriteInterfaceStats(idx int, s InterfaceStats) error {
+	if w.err != nil {
+		return w.err
+	}
+	if !w.ng {
+		return errors.New("interface statistics require the pcapng format")
+	}
+	if idx < 0 || idx >= len(w.ifaces) {
+		return fmt.Errorf("unknown interface index %d", idx)
+	}
+	ifc := &w.ifaces[idx]
+	b := appendBlockHeader(nil, blockISB)
+	b = binary.LittleEndian.AppendUint32(b, uint32(idx))
+	b = ifc.appendTimestamp(b, s.Timestamp)
+	if !s.StartTime.IsZero() {
+		b = appendOption(b, optISBStartTime, ifc.appendTimestamp(nil, s.StartTime))
+	}
+	if !s.EndTime.IsZero() {
+		b = appendOption(b, optISBEndTime, ifc.appendTimestamp(nil, s.EndTime))
+	}
+	b = appendOption(b, optISBIfRecv, binary.LittleEndian.AppendUint64(nil, s.Received))
+	b = appendOption(b, optISBIfDrop, binary.LittleEndian.AppendUint64(nil, s.Dropped))
+	b = appendOption(b, optEndOfOpt, nil)
+	b = appendBlockTrailer(b)
+	_, w.err = w.writer.Write(b)
+	return w.err
+}
+
+// writeNextNG writes the packet as an enhanced packet block.
+func (w *Writer) writeNextNG(p Packet) error {
+	if p.InterfaceIndex < 0 || p.InterfaceIndex >= len(w.ifaces) {
+		return fmt.Errorf("unknown interface index %d", p.InterfaceIndex)
+	}
+	ifc := &w.ifaces[p.InterfaceIndex]
+	if ifc.SnapLen > 0 && len(p.Data) > ifc.SnapLen {
+		return fmt.Errorf("capture length exceeds snapshot length: %d > %d", len(p.Data), ifc.SnapLen)
+	}
+	if uint64(len(p.Data)) > maxBlockSize-32 || uint64(p.OrigLen) > math.MaxUint32 {
+		return fmt.Errorf("packet length exceeds maximum: %d", p.OrigLen)
+	}
+	var b []byte
+	if wb, _ := w.writer.(*bufio.Writer); wb != nil {
+		b = wb.AvailableBuffer()
+	}
+	b = binary.LittleEndian.AppendUint32(b, blockEPB)
+	b = binary.LittleEndian.AppendUint32(b, uint32(32+(len(p.Data)+3)&^3))
+	b = binary.LittleEndian.AppendUint32(b, uint32(p.InterfaceIndex))
+	b = ifc.appendTimestamp(b, p.Timestamp)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(p.Data)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(p.OrigLen))
+	if _, w.err = w.writer.Write(b); w.err != nil {
+		return w.err
+	}
+	if _, w.err = w.writer.Write(p.Data); w.err != nil {
+		return w.err
+	}
+	var trailer [8]byte
+	pad := (4 - len(p.Data)%4) % 4
+	binary.LittleEndian.PutUint32(trailer[pad:], uint32(32+len(p.Data)+pad))
+	_, w.err = w.writer.Write(trailer[:pad+4])
+	return w.err
+}
+
+// appendTimestamp appends t as a pcapng timestamp in the interface units.
+func (ifc *ngInterface) appendTimestamp(b []byte, t time.Time) []byte {
+	sec := uint64(t.Unix() - ifc.offset)
+	ts := sec*ifc.units + uint64(t.Nanosecond())/(1e9/ifc.units)
+	b = binary.LittleEndian.AppendUint32(b, uint32(ts>>32))
+	return binary.LittleEndian.AppendUint32(b, uint32(ts))
+}
+
+// appendBlockHeader appends the block type and a placeholder for the length,
+// which is filled in by appendBlockTrailer.
+// The block must start at the beginning of b.
+func appendBlockHeader(b []byte, typ uint32) []byte {
+	b = binary.LittleEndian.AppendUint32(b, typ)
+	return binary.LittleEndian.AppendUint32(b, 0)
+}
+
+func appendBlockTrailer(b []byte) []byte {
+	n := uint32(len(b) + 4)
+	binary.LittleEndian.PutUint32(b[4:8], n)
+	return binary.LittleEndian.AppendUint32(b, n)
+}
+
+// appendOption appends an option, omitting empty values except for the end.
+func appendOption(b []byte, code uint16, v []byte) []byte {
+	if len(v) == 0 && code != optEndOfOpt {
+		return b
+	}
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(v)))
+	b = append(b, v...)
+	return append(b, make([]byte, (4-len(v)%4)%4)...)
+}
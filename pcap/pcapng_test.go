@@ -0,0 +1,239 @@
+// Copyright 2022, Joe Tsai. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE.md file.
+
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// ngBuilder constructs a pcapng stream in an arbitrary byte order.
+type ngBuilder struct {
+	order byteOrder
+	b     []byte
+}
+
+func (nb *ngBuilder) block(typ uint32, body []byte) {
+	body = append(body, make([]byte, (4-len(body)%4)%4)...)
+	n := uint32(12 + len(body))
+	nb.b = nb.order.AppendUint32(nb.b, typ)
+	nb.b = nb.order.AppendUint32(nb.b, n)
+	nb.b = append(nb.b, body...)
+	nb.b = nb.order.AppendUint32(nb.b, n)
+}
+
+func (nb *ngBuilder) option(b []byte, code uint16, v []byte) []byte {
+	b = nb.order.AppendUint16(b, code)
+	b = nb.order.AppendUint16(b, uint16(len(v)))
+	b = append(b, v...)
+	return append(b, make([]byte, (4-len(v)%4)%4)...)
+}
+
+func (nb *ngBuilder) shb() {
+	b := nb.order.AppendUint32(nil, byteOrderMagic)
+	b = nb.order.AppendUint16(b, 1)
+	b = nb.order.AppendUint16(b, 0)
+	b = nb.order.AppendUint64(b, ^uint64(0))
+	nb.block(blockSHB, b)
+}
+
+func (nb *ngBuilder) idb(lt LinkType, snapLen uint32, name string, tsresol byte) {
+	b := nb.order.AppendUint16(nil, uint16(lt))
+	b = nb.order.AppendUint16(b, 0)
+	b = nb.order.AppendUint32(b, snapLen)
+	b = nb.option(b, optIfName, []byte(name))
+	b = nb.option(b, optIfTSResol, []byte{tsresol})
+	b = nb.option(b, optEndOfOpt, nil)
+	nb.block(blockIDB, b)
+}
+
+func (nb *ngBuilder) epb(idx uint32, ts uint64, data []byte, origLen uint32) {
+	b := nb.order.AppendUint32(nil, idx)
+	b = nb.order.AppendUint32(b, uint32(ts>>32))
+	b = nb.order.AppendUint32(b, uint32(ts))
+	b = nb.order.AppendUint32(b, uint32(len(data)))
+	b = nb.order.AppendUint32(b, origLen)
+	nb.block(blockEPB, append(b, data...))
+}
+
+func (nb *ngBuilder) spb(data []byte) {
+	nb.block(blockSPB, append(nb.order.AppendUint32(nil, uint32(len(data))), data...))
+}
+
+func (nb *ngBuilder) nrb(recs ...NameRecord) {
+	var b []byte
+	for _, rec := range recs {
+		typ := uint16(nrbRecordIPv4)
+		if rec.Addr.Is6() {
+			typ = nrbRecordIPv6
+		}
+		v := rec.Addr.AsSlice()
+		for _, name := range rec.Names {
+			v = append(append(v, name...), 0)
+		}
+		b = nb.option(b, typ, v)
+	}
+	b = nb.option(b, nrbRecordEnd, nil)
+	nb.block(blockNRB, b)
+}
+
+// readAll reads all packets from r, which must end with io.EOF.
+func readAll(t *testing.T, r *Reader) []Packet {
+	t.Helper()
+	var ps []Packet
+	for {
+		p, err := r.ReadNext()
+		if err == io.EOF {
+			return ps
+		}
+		if err != nil {
+			t.Fatalf("ReadNext error: %v", err)
+		}
+		ps = append(ps, p.Clone())
+	}
+}
+
+func TestNGReader(t *testing.T) {
+	names := []NameRecord{
+		{Addr: netip.MustParseAddr("192.0.2.1"), Names: []string{"example.com", "www.example.com"}},
+		{Addr: netip.MustParseAddr("2001:db8::1")},
+	}
+	ts := time.Unix(1600000000, 123456789)
+	for _, order := range []byteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			nb := &ngBuilder{order: order}
+			nb.shb()
+			nb.idb(EthernetLinkType, 64, "eth0", 9)
+			nb.idb(RawLinkType, 0, "tun0", 6)
+			nb.nrb(names...)
+			nb.epb(1, uint64(ts.Unix())*1e6+uint64(ts.Nanosecond()/1e3), []byte("abcd"), 100)
+			nb.spb([]byte("abc"))
+			nb.epb(0, uint64(ts.UnixNano()), []byte("hello"), 5)
+
+			r, err := NewReader(bytes.NewReader(nb.b))
+			if err != nil {
+				t.Fatalf("NewReader error: %v", err)
+			}
+			if got, want := r.Header, (Header{SnapLen: 64, LinkType: EthernetLinkType}); got != want {
+				t.Errorf("Header = %+v, want %+v", got, want)
+			}
+			gotPackets := readAll(t, r)
+			wantPackets := []Packet{
+				{Timestamp: time.Unix(ts.Unix(), 123456000), OrigLen: 100, Data: []byte("abcd"), InterfaceIndex: 1},
+				{OrigLen: 3, Data: []byte("abc")},
+				{Timestamp: ts, OrigLen: 5, Data: []byte("hello")},
+			}
+			if len(gotPackets) != len(wantPackets) {
+				t.Fatalf("read %d packets, want %d", len(gotPackets), len(wantPackets))
+			}
+			for i := range gotPackets {
+				got, want := gotPackets[i], wantPackets[i]
+				if !got.Timestamp.Equal(want.Timestamp) || got.OrigLen != want.OrigLen ||
+					!bytes.Equal(got.Data, want.Data) || got.InterfaceIndex != want.InterfaceIndex {
+					t.Errorf("packet %d = %+v, want %+v", i, got, want)
+				}
+			}
+			wantIfaces := []Interface{
+				{LinkType: EthernetLinkType, SnapLen: 64, Name: "eth0", TimestampResolution: time.Nanosecond},
+				{LinkType: RawLinkType, Name: "tun0", TimestampResolution: time.Microsecond},
+			}
+			if got := r.Interfaces(); !reflect.DeepEqual(got, wantIfaces) {
+				t.Errorf("Interfaces() = %+v, want %+v", got, wantIfaces)
+			}
+			if got := r.NameRecords(); !reflect.DeepEqual(got, names) {
+				t.Errorf("NameRecords() = %+v, want %+v", got, names)
+			}
+		})
+	}
+}
+
+func TestNGRoundTrip(t *testing.T) {
+	var bb bytes.Buffer
+	w, err := NewNGWriter(&bb, Header{SnapLen: 64, LinkType: EthernetLinkType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifc := Interface{
+		LinkType:            IPv6LinkType,
+		SnapLen:             1500,
+		Name:                "tun0",
+		Description:         "tunnel",
+		TimestampResolution: time.Microsecond,
+		TimestampOffset:     time.Hour,
+	}
+	idx, err := w.AddInterface(ifc)
+	if err != nil || idx != 1 {
+		t.Fatalf("AddInterface = (%d, %v), want (1, nil)", idx, err)
+	}
+	names := []NameRecord{
+		{Addr: netip.MustParseAddr("192.0.2.1"), Names: []string{"example.com"}},
+		{Addr: netip.MustParseAddr("2001:db8::1"), Names: []string{"a.example.com", "b.example.com"}},
+		{Addr: netip.MustParseAddr("192.0.2.2")},
+	}
+	if err := w.WriteNameRecords(names); err != nil {
+		t.Fatalf("WriteNameRecords error: %v", err)
+	}
+	if err := w.WriteNameRecords([]NameRecord{{Names: []string{"invalid"}}}); err == nil {
+		t.Errorf("WriteNameRecords with invalid address succeeded, want error")
+	}
+	packets := []Packet{
+		{Timestamp: time.Unix(1600000000, 123456789), OrigLen: 10, Data: []byte("hello")},
+		{Timestamp: time.Unix(1600000001, 123456000), OrigLen: 4, Data: []byte("abcd"), InterfaceIndex: 1},
+		{Timestamp: time.Unix(1600000002, 0), OrigLen: 1, Data: []byte("x")},
+	}
+	stats := InterfaceStats{
+		Timestamp: time.Unix(1600000003, 0),
+		StartTime: time.Unix(1600000000, 0),
+		EndTime:   time.Unix(1600000003, 0),
+		Received:  3,
+		Dropped:   1,
+	}
+	for _, p := range packets {
+		if err := w.WriteNext(p); err != nil {
+			t.Fatalf("WriteNext error: %v", err)
+		}
+	}
+	if err := w.WriteInterfaceStats(1, stats); err != nil {
+		t.Fatalf("WriteInterfaceStats error: %v", err)
+	}
+
+	r, err := NewReader(&bb)
+	if err != nil {
+		t.Fatalf("NewReader error: %v", err)
+	}
+	gotPackets := readAll(t, r)
+	if len(gotPackets) != len(packets) {
+		t.Fatalf("read %d packets, want %d", len(gotPackets), len(packets))
+	}
+	for i := range gotPackets {
+		got, want := gotPackets[i], packets[i]
+		if !got.Timestamp.Equal(want.Timestamp) || got.OrigLen != want.OrigLen ||
+			!bytes.Equal(got.Data, want.Data) || got.InterfaceIndex != want.InterfaceIndex {
+			t.Errorf("packet %d = %+v, want %+v", i, got, want)
+		}
+	}
+	ifcs := r.Interfaces()
+	if len(ifcs) != 2 {
+		t.Fatalf("len(Interfaces()) = %d, want 2", len(ifcs))
+	}
+	gotStats := ifcs[1].Stats
+	ifcs[1].Stats = nil
+	wantIfaces := []Interface{{LinkType: EthernetLinkType, SnapLen: 64, TimestampResolution: time.Nanosecond}, ifc}
+	if !reflect.DeepEqual(ifcs, wantIfaces) {
+		t.Errorf("Interfaces() = %+v, want %+v", ifcs, wantIfaces)
+	}
+	if gotStats == nil || !gotStats.Timestamp.Equal(stats.Timestamp) || !gotStats.StartTime.Equal(stats.StartTime) ||
+		!gotStats.EndTime.Equal(stats.EndTime) || gotStats.Received != stats.Received || gotStats.Dropped != stats.Dropped {
+		t.Errorf("Interfaces()[1].Stats = %+v, want %+v", gotStats, stats)
+	}
+	if got := r.NameRecords(); !reflect.DeepEqual(got, names) {
+		t.Errorf("NameRecords() = %+v, want %+v", got, names)
+	}
+}